@@ -1,9 +1,35 @@
 package account
 
+import (
+	"github.com/florhusq/digibank/money"
+)
+
+// Status represents the stage of the life of an account
+type Status string
+
+// Supported Statuses
+const (
+	StatusOpen   = Status("open")   // The account can be operated on
+	StatusFrozen = Status("frozen") // No money can come in or go out until the account is unfrozen
+	StatusClosed = Status("closed") // The account can't be used anymore
+)
+
 // Account represents state of an account
 type Account struct {
-	ID       string  `json:"id"`       // The ID of the account
-	Customer string  `json:"customer"` // The customer owning the account
-	Version  uint    `json:"version"`  // The version of the amount
-	Amount   float64 `json:"amount"`   // The amount on the account
+	ID       string         `json:"id"`       // The ID of the account
+	Customer string         `json:"customer"` // The customer owning the account
+	Version  uint           `json:"version"`  // The version of the amount
+	Amount   money.Amount   `json:"amount"`   // The amount on the account
+	Currency money.Currency `json:"currency"` // The currency of the amount
+	Status   Status         `json:"status"`   // Whether the account can be operated on
+
+	OverdraftLimit money.Amount `json:"overdraftLimit"`   // How far below zero the amount may go
+	Limits         Limits       `json:"limits,omitempty"` // The limits of the account, overriding the default ones
+
+	Quarantined bool `json:"quarantined,omitempty"` // Whether an event involving the account was quarantined
+}
+
+// Available returns the money which can go out of the account, overdraft included
+func (a *Account) Available() (money.Amount, error) {
+	return a.Amount.Add(a.OverdraftLimit)
 }
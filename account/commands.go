@@ -1,27 +1,84 @@
 package account
 
+import (
+	"github.com/florhusq/digibank/money"
+)
+
+// Idempotent holds the key a client identifies a command with, so that a retried
+// command is processed only once
+type Idempotent struct {
+	IdempotencyKey string `json:"-"` // Client-supplied, empty if the command can't be retried
+}
+
+// key returns the idempotency key of the command
+func (i *Idempotent) key() string {
+	return i.IdempotencyKey
+}
+
 // DepositCommand requests to deposit an amount to an account from an ATM
 type DepositCommand struct {
-	AccountTo string  `json:"to"`     // The account which receives the money
-	Amount    float64 `json:"amount"` // The amount
+	Idempotent
+	AccountTo string       `json:"to"`     // The account which receives the money
+	Amount    money.Amount `json:"amount"` // The amount
 }
 
 // WithdrawCommand requests to withdraw an amount from an account via an ATM
 type WithdrawCommand struct {
-	AccountFrom string  `json:"from"`   // The account which sends the money
-	Amount      float64 `json:"amount"` // The amount
+	Idempotent
+	AccountFrom string       `json:"from"`   // The account which sends the money
+	Amount      money.Amount `json:"amount"` // The amount
 }
 
 // TransferCommand requests to transfer an amount between two accounts
 type TransferCommand struct {
-	AccountFrom string  `json:"from"`   // The account which sends the money
-	AccountTo   string  `json:"to"`     // The account which receives the money
-	Amount      float64 `json:"amount"` // The amount
+	Idempotent
+	AccountFrom string       `json:"from"`   // The account which sends the money
+	AccountTo   string       `json:"to"`     // The account which receives the money
+	Amount      money.Amount `json:"amount"` // The amount
 }
 
 // OpenAccountCommand requests the creation of a new account
 type OpenAccountCommand struct {
-	Customer string `json:"customer"` // The customer owning the new account
+	Idempotent
+	Customer string         `json:"customer"` // The customer owning the new account
+	Currency money.Currency `json:"currency"` // The currency of the account, the base currency if empty
+}
+
+// FreezeAccountCommand requests to stop all the operations on an account
+type FreezeAccountCommand struct {
+	Idempotent
+	AccountID string `json:"account"` // The account to freeze
+	Reason    string `json:"reason"`  // Why the account is frozen
+}
+
+// UnfreezeAccountCommand requests to allow the operations on a frozen account again
+type UnfreezeAccountCommand struct {
+	Idempotent
+	AccountID string `json:"account"` // The account to unfreeze
+}
+
+// CloseAccountCommand requests to close an account for good. An account with money
+// left can only be closed if the money is swept to another account.
+type CloseAccountCommand struct {
+	Idempotent
+	AccountID string `json:"account"` // The account to close
+	SweepTo   string `json:"sweepTo"` // The account receiving the money left, if any
+}
+
+// SetOverdraftLimitCommand requests to authorize an account to go below zero, down to
+// minus the limit
+type SetOverdraftLimitCommand struct {
+	Idempotent
+	AccountID string       `json:"account"` // The account authorized
+	Limit     money.Amount `json:"limit"`   // The overdraft authorized, 0 for none
+}
+
+// SetLimitCommand requests to change the limit of an account for a channel
+type SetLimitCommand struct {
+	Idempotent
+	AccountID string  `json:"account"` // The account limited
+	Channel   Channel `json:"channel"` // The channel limited
+	Limit     *Limit  `json:"limit"`   // The new limit, nil to fall back to the default one
 }
 
 // Command represents a command
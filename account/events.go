@@ -1,27 +1,71 @@
 package account
 
 import (
+	"encoding/json"
+
 	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/fx"
+	"github.com/florhusq/digibank/money"
 )
 
 const (
 	eventTransaction = "transaction"
 	eventOpenAccount = "openAccount"
+	eventFreeze      = "freezeAccount"
+	eventUnfreeze    = "unfreezeAccount"
+	eventClose       = "closeAccount"
+	eventOverdraft   = "setOverdraftLimit"
+	eventLimit       = "setLimit"
 )
 
 // EventStore represents an event source (dependency inversion principle)
 type EventStore interface {
 	Append(event event.Event) (uint, error)
+	AppendAll(events ...event.Event) error
+	AppendExpected(stream string, expected uint, events ...event.Event) error
+	AppendExpectedStreams(stream string, expected map[string]uint, events ...event.Event) error
 	FindChanges(after uint, names ...string) ([]event.Event, error)
+	FindStream(stream string, after uint) ([]event.Event, error)
+	FindIdempotent(key string) (event.Event, error)
+	Iterate(after uint, limit int, names ...string) *event.Iterator
+	IterateStream(stream string, after uint, limit int) *event.Iterator
+	Register(name string, event event.Event)
+	Upcast(name string, from uint, upcaster event.Upcaster)
+}
+
+// registrar represents an event source which creates events from their payloads
+type registrar interface {
 	Register(name string, event event.Event)
+	Upcast(name string, from uint, upcaster event.Upcaster)
+}
+
+// register registers the events of the accounts, and how to read their former versions
+func register(db registrar) {
+	db.Register(eventTransaction, &Transaction{})
+	db.Register(eventOpenAccount, &OpenAccount{})
+	db.Register(eventFreeze, &FreezeAccount{})
+	db.Register(eventUnfreeze, &UnfreezeAccount{})
+	db.Register(eventClose, &CloseAccount{})
+	db.Register(eventOverdraft, &SetOverdraftLimit{})
+	db.Register(eventLimit, &SetLimit{})
+	db.Upcast(eventTransaction, 1, upcastTransactionV1)
+}
+
+// Shredder represents an event source able to erase the personal data of a customer
+type Shredder interface {
+	Forget(subject string) error
 }
 
 // Transaction represents a transaction event
 type Transaction struct {
 	event.ID
-	AccountFrom string  `json:"from"`   // The account which sends the money
-	AccountTo   string  `json:"to"`     // The account which receives the money
-	Amount      float64 `json:"amount"` // The amount
+	AccountFrom string       `json:"from"`   // The account which sends the money
+	AccountTo   string       `json:"to"`     // The account which receives the money
+	Amount      money.Amount `json:"amount"` // The amount, in the currency of AccountFrom
+
+	// Set when the accounts are in different currencies
+	AmountTo money.Amount `json:"amountTo,omitempty"` // The amount credited, in the currency of AccountTo
+	Rate     *fx.Rate     `json:"rate,omitempty"`     // The rate the amount was converted at
 }
 
 // Name returns the event name
@@ -29,14 +73,123 @@ func (t *Transaction) Name() string {
 	return eventTransaction
 }
 
+// Credited returns the amount credited to AccountTo
+func (t *Transaction) Credited() money.Amount {
+	if t.Rate != nil {
+		return t.AmountTo
+	}
+	return t.Amount
+}
+
+// SchemaVersion returns the version of the payload. Version 1 held the amount as a
+// float.
+func (t *Transaction) SchemaVersion() uint {
+	return 2
+}
+
+// upcastTransactionV1 rounds the float amount of a transaction to the minor unit
+func upcastTransactionV1(data []byte) ([]byte, error) {
+	v1 := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, err
+	}
+
+	var f float64
+	if err := json.Unmarshal(v1["amount"], &f); err != nil {
+		return nil, err
+	}
+	amount, err := money.FromFloat(f)
+	if err != nil {
+		return nil, err
+	}
+	if v1["amount"], err = json.Marshal(amount); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v1)
+}
+
+// Links returns the other account of the transaction, so it can be found from the
+// streams of both accounts
+func (t *Transaction) Links() []string {
+	if t.AccountFrom == "ATM" || t.AccountTo == "ATM" {
+		return nil
+	}
+	return []string{t.AccountTo}
+}
+
 // OpenAccount represents the opening of an account
 type OpenAccount struct {
 	event.ID
-	AccountID string `json:"account"`  // The ID of the new account
-	Customer  string `json:"customer"` // The customer owning the new account
+	AccountID string         `json:"account"`                  // The ID of the new account
+	Customer  string         `json:"customer" personal:"true"` // The customer owning the new account
+	Currency  money.Currency `json:"currency,omitempty"`       // The currency of the account, the base currency if empty
 }
 
 // Name returns the event name
 func (oa *OpenAccount) Name() string {
 	return eventOpenAccount
 }
+
+// Subject returns the customer the personal data is about
+func (oa *OpenAccount) Subject() string {
+	return oa.Customer
+}
+
+// FreezeAccount represents an account being frozen
+type FreezeAccount struct {
+	event.ID
+	AccountID string `json:"account"` // The account frozen
+	Reason    string `json:"reason"`  // Why the account was frozen
+}
+
+// Name returns the event name
+func (f *FreezeAccount) Name() string {
+	return eventFreeze
+}
+
+// UnfreezeAccount represents a frozen account being allowed operations again
+type UnfreezeAccount struct {
+	event.ID
+	AccountID string `json:"account"` // The account unfrozen
+}
+
+// Name returns the event name
+func (u *UnfreezeAccount) Name() string {
+	return eventUnfreeze
+}
+
+// CloseAccount represents the closing of an account, whose balance is zero
+type CloseAccount struct {
+	event.ID
+	AccountID string `json:"account"` // The account closed
+}
+
+// Name returns the event name
+func (c *CloseAccount) Name() string {
+	return eventClose
+}
+
+// SetOverdraftLimit represents a change of the overdraft authorized on an account
+type SetOverdraftLimit struct {
+	event.ID
+	AccountID string       `json:"account"` // The account authorized
+	Limit     money.Amount `json:"limit"`   // The overdraft authorized
+}
+
+// Name returns the event name
+func (s *SetOverdraftLimit) Name() string {
+	return eventOverdraft
+}
+
+// SetLimit represents a change of the limit of an account for a channel
+type SetLimit struct {
+	event.ID
+	AccountID string  `json:"account"` // The account limited
+	Channel   Channel `json:"channel"` // The channel limited
+	Limit     *Limit  `json:"limit"`   // The new limit, nil for the default one
+}
+
+// Name returns the event name
+func (s *SetLimit) Name() string {
+	return eventLimit
+}
@@ -0,0 +1,173 @@
+package account
+
+import (
+	"time"
+
+	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/money"
+	"gorm.io/gorm"
+)
+
+// Directions of the money in a history entry
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// HistoryEntry represents a transaction as seen from one of its accounts
+type HistoryEntry struct {
+	ID            uint         `gorm:"primarykey" json:"-"`
+	Account       string       `gorm:"uniqueIndex:idx_history_account" json:"account"` // The account the entry belongs to
+	EventID       uint         `gorm:"uniqueIndex:idx_history_account" json:"eventId"` // The transaction
+	Direction     string       `json:"direction"`                                      // Whether the money came in or went out
+	Counterparty  string       `json:"counterparty"`                                   // The other account, or ATM
+	Amount        money.Amount `json:"amount"`                                         // The amount
+	Balance       money.Amount `json:"balance"`                                        // The balance of the account after the transaction
+	OccurredAt    time.Time    `json:"time"`                                           // When the transaction happened
+	CausationID   string       `json:"request"`                                        // The request which caused the transaction
+	CorrelationID string       `json:"correlation"`                                    // The conversation the request is part of
+}
+
+// Source represents the events the history rebuilds the accounts from, when it
+// resumes from a checkpoint
+type Source interface {
+	Iterate(after uint, limit int, names ...string) *event.Iterator
+}
+
+// History is the read model of the transactions of each account, fed by a
+// projection runner. Like the accounts, it leaves out the transactions which break
+// their invariants, so the balances match.
+type History struct {
+	db      *gorm.DB
+	source  Source
+	replay  state // The accounts as of the last event handled
+	resumed bool  // Whether replay was rebuilt up to the events handled
+}
+
+// NewHistory creates the history, stored in its own table of a database. base is the
+// currency of the accounts opened without one.
+func NewHistory(db *gorm.DB, source Source, base money.Currency) (*History, error) {
+	if err := db.AutoMigrate(&HistoryEntry{}); err != nil {
+		return nil, err
+	}
+	return &History{
+		db:     db,
+		source: source,
+		replay: newState(base),
+	}, nil
+}
+
+// Name returns the name of the projection
+func (h *History) Name() string {
+	return "history"
+}
+
+// Events returns the names of the events the history is built from, which are all
+// of the events of the accounts, to tell which transactions are quarantined
+func (h *History) Events() []string {
+	return replayed
+}
+
+// Handle records a transaction in the history of its accounts. A transaction which
+// was already recorded, or which is quarantined, is skipped.
+func (h *History) Handle(e event.Event) error {
+	if err := h.resume(event.IDOf(e)); err != nil {
+		return err
+	}
+	if event.IDOf(e) > h.replay.version {
+		h.replay.apply(e)
+	}
+
+	t, ok := e.(*Transaction)
+	if !ok || h.replay.quarantined(t.EventID) {
+		return nil
+	}
+
+	meta := t.Metadata()
+	entries := []HistoryEntry{}
+	if t.AccountFrom != "ATM" {
+		entries = append(entries, HistoryEntry{
+			Account:      t.AccountFrom,
+			Direction:    DirectionOut,
+			Counterparty: t.AccountTo,
+			Amount:       t.Amount,
+		})
+	}
+	if t.AccountTo != "ATM" {
+		entries = append(entries, HistoryEntry{
+			Account:      t.AccountTo,
+			Direction:    DirectionIn,
+			Counterparty: t.AccountFrom,
+			Amount:       t.Credited(),
+		})
+	}
+
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		for _, entry := range entries {
+			entry.EventID = event.IDOf(e)
+			entry.OccurredAt = meta.OccurredAt
+			entry.CausationID = meta.CausationID
+			entry.CorrelationID = meta.CorrelationID
+
+			last := HistoryEntry{}
+			if err := tx.
+				Where("account = ?", entry.Account).
+				Order("event_id DESC").
+				Limit(1).
+				Find(&last).Error; err != nil {
+				return err
+			}
+			if last.EventID >= entry.EventID {
+				continue
+			}
+
+			var err error
+			if entry.Direction == DirectionOut {
+				entry.Balance, err = last.Balance.Sub(entry.Amount)
+			} else {
+				entry.Balance, err = last.Balance.Add(entry.Amount)
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&entry).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// resume rebuilds the accounts up to an event, the first time the history handles one
+func (h *History) resume(eventID uint) error {
+	if h.resumed {
+		return nil
+	}
+
+	it := h.source.Iterate(h.replay.version, readBatch, replayed...)
+	for it.Next() && event.IDOf(it.Event()) < eventID {
+		h.replay.apply(it.Event())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	h.resumed = true
+	return nil
+}
+
+// Reset drops the whole history
+func (h *History) Reset() error {
+	h.replay = newState(h.replay.base)
+	h.resumed = false
+	return h.db.Where("1 = 1").Delete(&HistoryEntry{}).Error
+}
+
+// View returns the history of an account, oldest first
+func (h *History) View(account string) ([]HistoryEntry, error) {
+	entries := []HistoryEntry{}
+	err := h.db.
+		Where("account = ?", account).
+		Order("event_id").
+		Find(&entries).Error
+	return entries, err
+}
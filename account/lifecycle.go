@@ -0,0 +1,115 @@
+package account
+
+import (
+	"context"
+	"errors"
+
+	"github.com/florhusq/digibank/event"
+)
+
+// Errors returned when the status of an account does not allow a command
+var (
+	ErrFrozen      = errors.New("account is frozen")
+	ErrClosed      = errors.New("account is closed")
+	ErrNotFrozen   = errors.New("account is not frozen")
+	ErrBalanceLeft = errors.New("account still holds money, which must be swept to another account")
+)
+
+// ErrSweepToSelf is returned when an account is closed with itself to sweep its money to
+var ErrSweepToSelf = errors.New("account can't be swept to itself")
+
+// operable returns an error unless money can come in and go out of the accounts
+func operable(accounts ...*Account) error {
+	for _, acc := range accounts {
+		switch {
+		case acc.Status == StatusFrozen:
+			return ErrFrozen
+		case acc.Status == StatusClosed:
+			return ErrClosed
+		case acc.Quarantined:
+			return ErrQuarantined
+		}
+	}
+	return nil
+}
+
+// freeze is the command that stops all the operations on an account
+func (m *Manager) freeze(ctx context.Context, command *FreezeAccountCommand) error {
+	return m.appendEvents(ctx, func() (*Account, []event.Event, error) {
+		acc, err := m.findAccount(command.AccountID)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if acc.Status != StatusOpen {
+			return nil, nil, operable(acc)
+		}
+
+		return acc, []event.Event{&FreezeAccount{
+			AccountID: acc.ID,
+			Reason:    command.Reason,
+		}}, nil
+	})
+}
+
+// unfreeze is the command that allows the operations on a frozen account again
+func (m *Manager) unfreeze(ctx context.Context, command *UnfreezeAccountCommand) error {
+	return m.appendEvents(ctx, func() (*Account, []event.Event, error) {
+		acc, err := m.findAccount(command.AccountID)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if acc.Status != StatusFrozen {
+			return nil, nil, ErrNotFrozen
+		}
+
+		return acc, []event.Event{&UnfreezeAccount{AccountID: acc.ID}}, nil
+	})
+}
+
+// close is the command that closes an account, after sweeping the money left to
+// another account if needed
+func (m *Manager) close(ctx context.Context, command *CloseAccountCommand) error {
+	return m.appendEvents(ctx, func() (*Account, []event.Event, error) {
+		acc, err := m.findAccount(command.AccountID)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if err := operable(acc); err != nil {
+			return nil, nil, err
+		}
+
+		events := []event.Event{}
+		if acc.Amount != 0 {
+			if acc.Amount < 0 || command.SweepTo == "" {
+				return nil, nil, ErrBalanceLeft
+			}
+			if command.SweepTo == acc.ID {
+				return nil, nil, ErrSweepToSelf
+			}
+			accTo, err := m.findAccount(command.SweepTo)
+			if err != nil {
+				return nil, nil, errNoAccount
+			}
+			if err := operable(accTo); err != nil {
+				return nil, nil, err
+			}
+
+			tx := &Transaction{
+				AccountFrom: acc.ID,
+				AccountTo:   accTo.ID,
+				Amount:      acc.Amount,
+			}
+			if acc.Currency != accTo.Currency {
+				if err := m.convert(tx, acc.Currency, accTo.Currency); err != nil {
+					return nil, nil, err
+				}
+			}
+			if _, err := accTo.Amount.Add(tx.Credited()); err != nil {
+				return nil, nil, err
+			}
+			events = append(events, tx)
+		}
+
+		return acc, append(events, &CloseAccount{AccountID: acc.ID}), nil
+	})
+}
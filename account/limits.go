@@ -0,0 +1,140 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/money"
+)
+
+// Channel represents the way money leaves an account
+type Channel string
+
+// Supported Channels
+const (
+	ChannelWithdrawal = Channel("withdrawal") // Cash taken out through an ATM
+	ChannelTransfer   = Channel("transfer")   // Money sent to another account
+)
+
+// window is the rolling period over which the daily limits apply
+const window = 24 * time.Hour
+
+var errUnknownChannel = errors.New("unknown channel")
+var errInvalidLimit = errors.New("limits can't be negative")
+
+// Limit caps the money leaving an account through a channel, in the currency of the
+// account. A zero cap means no limit.
+type Limit struct {
+	PerTransaction money.Amount `json:"perTransaction"` // The most a single transaction can take out
+	Daily          money.Amount `json:"daily"`          // The most that can go out over any 24 hours
+}
+
+// valid tells if the caps of the limit can be applied
+func (l Limit) valid() bool {
+	return l.PerTransaction >= 0 && l.Daily >= 0
+}
+
+// Limits holds the limits by channel
+type Limits map[Channel]Limit
+
+// LimitError is returned when a transaction would take out more money than a limit
+// of the account allows
+type LimitError struct {
+	Channel Channel      // The channel the money would go out through
+	Cap     money.Amount // The cap which would be exceeded
+	Daily   bool         // Whether the cap is over 24 hours rather than per transaction
+}
+
+func (e *LimitError) Error() string {
+	if e.Daily {
+		return fmt.Sprintf("%s limit of %v over 24 hours exceeded", e.Channel, e.Cap)
+	}
+	return fmt.Sprintf("%s limit of %v per transaction exceeded", e.Channel, e.Cap)
+}
+
+// outflow represents money which left an account, kept for the daily limits
+type outflow struct {
+	At      time.Time    `json:"at"`
+	Channel Channel      `json:"channel"`
+	Amount  money.Amount `json:"amount"`
+}
+
+// channelOf returns the channel a transaction takes money out through
+func channelOf(t *Transaction) Channel {
+	if t.AccountTo == "ATM" {
+		return ChannelWithdrawal
+	}
+	return ChannelTransfer
+}
+
+// WithLimits sets the limits of the accounts which have no limit of their own for a
+// channel. There are no limits by default.
+func WithLimits(defaults Limits) Option {
+	return func(m *Manager) {
+		m.limits = defaults
+	}
+}
+
+// checkLimit returns a *LimitError if taking an amount out of an account through a
+// channel exceeds the limit of the account, or the default one
+func (m *Manager) checkLimit(acc *Account, channel Channel, amount money.Amount) error {
+	limit, ok := acc.Limits[channel]
+	if !ok {
+		limit = m.limits[channel]
+	}
+
+	if limit.PerTransaction != 0 && amount > limit.PerTransaction {
+		return &LimitError{Channel: channel, Cap: limit.PerTransaction}
+	}
+	if limit.Daily == 0 {
+		return nil
+	}
+
+	since := time.Now().Add(-window)
+	total := amount
+	for _, out := range m.outflows[acc.ID] {
+		if out.Channel != channel || !out.At.After(since) {
+			continue
+		}
+		var err error
+		if total, err = total.Add(out.Amount); err != nil {
+			return err
+		}
+	}
+	if total > limit.Daily {
+		return &LimitError{Channel: channel, Cap: limit.Daily, Daily: true}
+	}
+	return nil
+}
+
+// setLimit is the command that changes the limit of an account for a channel
+func (m *Manager) setLimit(ctx context.Context, command *SetLimitCommand) error {
+	if command.Channel != ChannelWithdrawal && command.Channel != ChannelTransfer {
+		return errUnknownChannel
+	}
+	if command.Limit != nil && !command.Limit.valid() {
+		return errInvalidLimit
+	}
+
+	return m.appendEvents(ctx, func() (*Account, []event.Event, error) {
+		acc, err := m.findAccount(command.AccountID)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if acc.Status == StatusClosed {
+			return nil, nil, ErrClosed
+		}
+		if acc.Quarantined {
+			return nil, nil, ErrQuarantined
+		}
+
+		return acc, []event.Event{&SetLimit{
+			AccountID: acc.ID,
+			Channel:   command.Channel,
+			Limit:     command.Limit,
+		}}, nil
+	})
+}
@@ -1,10 +1,19 @@
 package account
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/fx"
+	"github.com/florhusq/digibank/money"
 	"github.com/google/uuid"
 )
 
@@ -13,160 +22,459 @@ import (
 
 var errNoAccount = errors.New("account not found")
 var errInsufficientFunds = errors.New("insufficient funds")
+var errNoRates = errors.New("no exchange rates between the currencies")
+
+// ErrQuarantined is returned for the commands on an account whose events were quarantined
+var ErrQuarantined = errors.New("account is blocked because events involving it were quarantined")
+
+// ErrKeyReused is returned when an idempotency key is used again for a different command
+var ErrKeyReused = errors.New("idempotency key was already used for a different request")
+
+// ErrInvalidAmount is returned when a command would move no money, or a negative amount
+var ErrInvalidAmount = errors.New("amount must be positive")
+
+// maxAttempts is the number of times a command is decided again when another writer
+// appended to the same stream in the meantime
+const maxAttempts = 5
+
+// readBatch is the number of events read at once from the event store
+const readBatch = 500
 
 // Manager represents a manager for the transactions
 type Manager struct {
-	lock     sync.Mutex
-	db       EventStore
-	accounts map[string]*Account
+	state
+	lock sync.Mutex
+	db   EventStore
+
+	snapshots        SnapshotStore // Where the snapshots are saved, if any
+	snapshotInterval uint          // Number of events between two snapshots
+	snapshotVersion  uint          // The ID of the last event in the latest snapshot
+
+	replayMode ReplayMode // How to start when events were quarantined
+	rates      *fx.Table  // The rates transfers between currencies are converted at, if any
+	limits     Limits     // The limits of the accounts without their own
+}
+
+// Option configures a manager
+type Option func(*Manager)
+
+// WithBaseCurrency sets the currency of the accounts opened without one, money.DefaultCurrency
+// by default. It must not change once accounts were opened.
+func WithBaseCurrency(base money.Currency) Option {
+	return func(m *Manager) {
+		if base != "" {
+			m.base = base
+		}
+	}
+}
+
+// WithRates lets the manager transfer between accounts in different currencies, at the
+// rates of a table
+func WithRates(rates *fx.Table) Option {
+	return func(m *Manager) {
+		m.rates = rates
+	}
 }
 
 // NewManager creates a new manager for transactions
-func NewManager(db EventStore) (*Manager, error) {
-	db.Register(eventTransaction, &Transaction{})
-	db.Register(eventOpenAccount, &OpenAccount{})
+func NewManager(db EventStore, options ...Option) (*Manager, error) {
+	register(db)
 	m := &Manager{
-		db:       db,
-		accounts: make(map[string]*Account, 0),
+		state:      newState(money.DefaultCurrency),
+		db:         db,
+		replayMode: ReplayStrict,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	for channel, limit := range m.limits {
+		if !limit.valid() {
+			return nil, fmt.Errorf("account: default %s limit: %w", channel, errInvalidLimit)
+		}
 	}
-	// Replay all the changes to rebuild the database
-	m.ApplyChanges()
+
+	// Start from the latest snapshot, falling back to a full replay if it can't be used
+	if m.snapshots != nil {
+		if err := m.restore(); err != nil && err != event.ErrNoSnapshot {
+			log.Println("account: replaying all the changes:", err)
+		}
+	}
+
+	// Replay the changes to rebuild the database
+	if err := m.catchUp(); err != nil {
+		return nil, err
+	}
+	if len(m.quarantine) > 0 {
+		if m.replayMode != ReplayDegraded {
+			return nil, &QuarantineError{Violations: m.quarantine}
+		}
+		for _, v := range m.quarantine {
+			log.Printf("account: event %d quarantined (%s), frozen accounts: %v", v.EventID, v.Reason, v.Accounts)
+		}
+	}
+	m.snapshot()
 	return m, nil
 }
 
-// Process processes commands
-func (m *Manager) Process(command Command) (string, error) {
+// Process processes commands. The events are appended with the metadata carried
+// by the context. A command whose idempotency key was already used is not processed
+// again, and returns the result of the original command, or ErrKeyReused if the key
+// was used for a different command.
+func (m *Manager) Process(ctx context.Context, command Command) (string, error) {
+	idempotent, ok := command.(interface{ key() string })
+	if !ok || idempotent.key() == "" {
+		return m.process(ctx, command)
+	}
+
+	key, hash := idempotent.key(), fingerprint(command)
+	if result, found, err := m.processed(key, hash); err != nil || found {
+		return result, err
+	}
+
+	meta := event.FromContext(ctx)
+	meta.IdempotencyKey, meta.RequestHash = key, hash
+	result, err := m.process(event.NewContext(ctx, meta), command)
+
+	// Another writer processed the same command in the meantime
+	var duplicate *event.DuplicateError
+	if errors.As(err, &duplicate) {
+		result, _, err = m.processed(key, hash)
+	}
+	return result, err
+}
+
+// fingerprint identifies a command by its type and fields, its idempotency key aside
+func fingerprint(command Command) string {
+	b, err := json.Marshal(command)
+	if err != nil {
+		panic(err) // Commands only hold plain values
+	}
+	sum := sha256.Sum256(append([]byte(fmt.Sprintf("%T", command)), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+// processed returns the result of the command processed with an idempotency key,
+// if any. ErrKeyReused is returned if it was a different command.
+func (m *Manager) processed(key, hash string) (string, bool, error) {
+	e, err := m.db.FindIdempotent(key)
+	if err != nil || e == nil {
+		return "", false, err
+	}
+	if e.Metadata().RequestHash != hash {
+		return "", true, ErrKeyReused
+	}
+
+	if e, ok := e.(*OpenAccount); ok {
+		return e.AccountID, true, nil
+	}
+	return "", true, nil
+}
+
+// process processes a command
+func (m *Manager) process(ctx context.Context, command Command) (string, error) {
 	switch command := command.(type) {
 	case *DepositCommand:
-		return m.deposit(command)
+		return m.deposit(ctx, command)
 	case *WithdrawCommand:
-		return m.withdraw(command)
+		return m.withdraw(ctx, command)
 	case *TransferCommand:
-		return m.transfer(command)
+		return m.transfer(ctx, command)
 	case *OpenAccountCommand:
-		return m.createAccount(command.Customer)
+		return m.createAccount(ctx, command)
+	case *FreezeAccountCommand:
+		return "", m.freeze(ctx, command)
+	case *UnfreezeAccountCommand:
+		return "", m.unfreeze(ctx, command)
+	case *CloseAccountCommand:
+		return "", m.close(ctx, command)
+	case *SetOverdraftLimitCommand:
+		return "", m.setOverdraftLimit(ctx, command)
+	case *SetLimitCommand:
+		return "", m.setLimit(ctx, command)
 	}
 
 	return "", nil
 }
 
 // transfer is the command that transfers money from an account to another
-func (m *Manager) transfer(command *TransferCommand) (string, error) {
-	if _, err := m.findAccount(command.AccountTo); err != nil {
-		return "", errNoAccount
-	}
-	accFrom, err := m.findAccount(command.AccountFrom)
-	if err != nil {
-		return "", errNoAccount
-	}
-	if accFrom.Amount < command.Amount {
-		return "", errInsufficientFunds
+func (m *Manager) transfer(ctx context.Context, command *TransferCommand) (string, error) {
+	if command.Amount <= 0 {
+		return "", ErrInvalidAmount
 	}
 
-	m.appendTx(&Transaction{
-		AccountFrom: command.AccountFrom,
-		AccountTo:   command.AccountTo,
-		Amount:      command.Amount,
-	})
+	return "", m.appendTx(ctx, func() (*Account, *Transaction, error) {
+		accTo, err := m.findAccount(command.AccountTo)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		accFrom, err := m.findAccount(command.AccountFrom)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if err := operable(accFrom, accTo); err != nil {
+			return nil, nil, err
+		}
+		if available, err := accFrom.Available(); err != nil || available < command.Amount {
+			return nil, nil, errInsufficientFunds
+		}
+		if err := m.checkLimit(accFrom, ChannelTransfer, command.Amount); err != nil {
+			return nil, nil, err
+		}
 
-	return "", nil
+		tx := &Transaction{
+			AccountFrom: command.AccountFrom,
+			AccountTo:   command.AccountTo,
+			Amount:      command.Amount,
+		}
+		if accFrom.Currency != accTo.Currency {
+			if err := m.convert(tx, accFrom.Currency, accTo.Currency); err != nil {
+				return nil, nil, err
+			}
+		}
+		if _, err := accTo.Amount.Add(tx.Credited()); err != nil {
+			return nil, nil, err
+		}
+		return accFrom, tx, nil
+	})
 }
 
-// withdraw is the command that withdraws money from the account
-func (m *Manager) withdraw(command *WithdrawCommand) (string, error) {
-	acc, err := m.findAccount(command.AccountFrom)
+// convert converts the amount of a transaction between two currencies. ErrInvalidAmount
+// is returned if a tiny amount is worth nothing once converted.
+func (m *Manager) convert(tx *Transaction, from, to money.Currency) error {
+	if m.rates == nil {
+		return errNoRates
+	}
+	rate, err := m.rates.Rate(from, to)
 	if err != nil {
-		return "", errNoAccount
+		return err
 	}
-	if acc.Amount < command.Amount {
-		return "", errInsufficientFunds
+	if tx.AmountTo, err = rate.Convert(tx.Amount); err != nil {
+		return err
 	}
+	if tx.AmountTo <= 0 {
+		return ErrInvalidAmount
+	}
+	tx.Rate = &rate
+	return nil
+}
 
-	m.appendTx(&Transaction{
-		AccountFrom: command.AccountFrom,
-		AccountTo:   "ATM",
-		Amount:      command.Amount,
-	})
+// withdraw is the command that withdraws money from the account
+func (m *Manager) withdraw(ctx context.Context, command *WithdrawCommand) (string, error) {
+	if command.Amount <= 0 {
+		return "", ErrInvalidAmount
+	}
 
-	return "", nil
+	return "", m.appendTx(ctx, func() (*Account, *Transaction, error) {
+		acc, err := m.findAccount(command.AccountFrom)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if err := operable(acc); err != nil {
+			return nil, nil, err
+		}
+		if available, err := acc.Available(); err != nil || available < command.Amount {
+			return nil, nil, errInsufficientFunds
+		}
+		if err := m.checkLimit(acc, ChannelWithdrawal, command.Amount); err != nil {
+			return nil, nil, err
+		}
+
+		return acc, &Transaction{
+			AccountFrom: command.AccountFrom,
+			AccountTo:   "ATM",
+			Amount:      command.Amount,
+		}, nil
+	})
 }
 
 // deposit is the command that deposits money into an account
-func (m *Manager) deposit(command *DepositCommand) (string, error) {
-	if _, err := m.findAccount(command.AccountTo); err != nil {
-		return "", errNoAccount
+func (m *Manager) deposit(ctx context.Context, command *DepositCommand) (string, error) {
+	if command.Amount <= 0 {
+		return "", ErrInvalidAmount
 	}
 
-	m.appendTx(&Transaction{
-		AccountFrom: "ATM",
-		AccountTo:   command.AccountTo,
-		Amount:      command.Amount,
-	})
+	return "", m.appendTx(ctx, func() (*Account, *Transaction, error) {
+		acc, err := m.findAccount(command.AccountTo)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if err := operable(acc); err != nil {
+			return nil, nil, err
+		}
+		if _, err := acc.Amount.Add(command.Amount); err != nil {
+			return nil, nil, err
+		}
 
-	return "", nil
+		return acc, &Transaction{
+			AccountFrom: "ATM",
+			AccountTo:   command.AccountTo,
+			Amount:      command.Amount,
+		}, nil
+	})
 }
 
 // createAccount is the command that creates an account.
-func (m *Manager) createAccount(customer string) (string, error) {
+func (m *Manager) createAccount(ctx context.Context, command *OpenAccountCommand) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	currency := m.base
+	if command.Currency != "" {
+		var err error
+		if currency, err = money.ParseCurrency(string(command.Currency)); err != nil {
+			return "", err
+		}
+	}
+
+	meta := event.FromContext(ctx)
 	event := &OpenAccount{
 		AccountID: uuid.New().String(),
-		Customer:  customer,
+		Customer:  command.Customer,
+		Currency:  currency,
 	}
+	event.SetMetadata(meta)
 
-	_, err := m.db.Append(event)
-	if err != nil {
+	// A brand new account has an empty stream
+	if err := m.db.AppendExpected(event.AccountID, 0, event); err != nil {
 		return "", err
 	}
 
 	m.Apply(event)
+	m.snapshot()
 
 	return event.AccountID, nil
 }
 
-// findAccount finds an account baed on its ID.
-func (m *Manager) findAccount(ID string) (*Account, error) {
-	acc, ok := m.accounts[ID]
+// ForgetCustomer erases the personal data of a customer. The accounts of the customer
+// remain, with their balance, but the customer shows as redacted.
+func (m *Manager) ForgetCustomer(customer string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	shredder, ok := m.db.(Shredder)
 	if !ok {
-		return nil, errNoAccount
+		return errors.New("account: the event store can't erase personal data")
+	}
+	if err := shredder.Forget(customer); err != nil {
+		return err
+	}
+
+	for _, acc := range m.accounts {
+		if acc.Customer == customer {
+			acc.Customer = event.Redacted
+		}
+	}
+
+	// The latest snapshot still holds the customer in clear
+	if m.snapshots != nil {
+		return m.saveSnapshot()
 	}
-	return acc, nil
+	return nil
 }
 
-// appendTx adds a transaction to the database
-func (m *Manager) appendTx(tx *Transaction) error {
+// appendTx decides a transaction and adds it to the database, like appendEvents
+func (m *Manager) appendTx(ctx context.Context, decide func() (*Account, *Transaction, error)) error {
+	return m.appendEvents(ctx, func() (*Account, []event.Event, error) {
+		acc, tx, err := decide()
+		if err != nil {
+			return nil, nil, err
+		}
+		return acc, []event.Event{tx}, nil
+	})
+}
+
+// appendEvents decides events and adds them to the database, expecting the stream of
+// the account returned by decide, and the streams of the accounts the events are linked
+// to, to still be at the versions of those accounts. If another writer appended to one of
+// them in the meantime, the manager catches up with the changes and decides again.
+func (m *Manager) appendEvents(ctx context.Context, decide func() (*Account, []event.Event, error)) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	_, err := m.db.Append(tx)
-	if err != nil {
-		return err
-	}
+	for attempt := 1; ; attempt++ {
+		acc, events, err := decide()
+		if err != nil {
+			return err
+		}
+		// The time is set before the append, so the state applies the same one as a replay
+		meta := event.FromContext(ctx)
+		if meta.OccurredAt.IsZero() {
+			meta.OccurredAt = time.Now()
+		}
+		meta.OccurredAt = meta.OccurredAt.UTC().Truncate(time.Microsecond)
+		for _, e := range events {
+			e.SetMetadata(meta)
+		}
 
-	m.Apply(tx)
+		err = m.db.AppendExpectedStreams(acc.ID, m.expected(acc, events), events...)
+		var conflict *event.ConflictError
+		switch {
+		case err == nil:
+			// The events are read back in order, after the ones other writers appended
+			// in the meantime. The command succeeded even if they can't be read yet.
+			if err := m.catchUp(); err != nil {
+				log.Println("account: unable to catch up after appending:", err)
+			}
+			m.snapshot()
+			return nil
+		case errors.As(err, &conflict) && attempt < maxAttempts:
+			if err := m.catchUp(); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
 
-	return nil
+// expected returns the versions the streams of an account and of the accounts linked
+// to its events must still be at
+func (m *Manager) expected(acc *Account, events []event.Event) map[string]uint {
+	expected := map[string]uint{acc.ID: acc.Version}
+	for _, e := range events {
+		linked, ok := e.(event.Linked)
+		if !ok {
+			continue
+		}
+		for _, stream := range linked.Links() {
+			if other, ok := m.accounts[stream]; ok && stream != acc.ID {
+				expected[stream] = other.Version
+			}
+		}
+	}
+	return expected
 }
 
 // ViewTransactions shows all of the transactions for a user
 func (m *Manager) ViewTransactions(account string) ([]Transaction, error) {
-	events, err := m.db.FindChanges(0, eventTransaction)
-	if err != nil {
-		return nil, err
-	}
-
-	// Filter by account name
+	// The stream also holds the opening of the account
 	result := []Transaction{}
-	for _, v := range events {
-		tx := *v.(*Transaction)
-		if tx.AccountFrom == account || tx.AccountTo == account {
-			result = append(result, *v.(*Transaction))
+	it := m.db.IterateStream(account, 0, readBatch)
+	for it.Next() {
+		if tx, ok := it.Event().(*Transaction); ok {
+			result = append(result, *tx)
 		}
 	}
-	return result, nil
+	return result, it.Err()
+}
+
+// ViewAccount shows the state of the account
+func (m *Manager) ViewAccount(accountID string) (Account, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	acc, err := m.findAccount(accountID)
+	if err != nil {
+		return Account{}, err
+	}
+	return *acc, nil
 }
 
 // ViewBalance shows the balance of the account
-func (m *Manager) ViewBalance(accountID string) (float64, error) {
+func (m *Manager) ViewBalance(accountID string) (money.Amount, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	acc, err := m.findAccount(accountID)
 	if err != nil {
 		return 0, err
@@ -176,37 +484,22 @@ func (m *Manager) ViewBalance(accountID string) (float64, error) {
 
 // Apply applies the event received
 func (m *Manager) Apply(e event.Event) {
-	switch e := e.(type) {
-	case *OpenAccount:
-		m.accounts[e.AccountID] = &Account{
-			ID:       e.AccountID,
-			Customer: e.Customer,
-			Amount:   0,
-			Version:  e.EventID,
-		}
-	case *Transaction:
-		// Error is ignored because the account is supposed to be existing at this stage
-		if e.AccountFrom != "ATM" {
-			accFrom, _ := m.findAccount(e.AccountFrom)
-			accFrom.Amount -= e.Amount
-			accFrom.Version = e.EventID
-		}
-
-		if e.AccountTo != "ATM" {
-			accTo, _ := m.findAccount(e.AccountTo)
-			accTo.Amount += e.Amount
-			accTo.Version = e.EventID
-		}
-	}
+	m.apply(e)
 }
 
-// ApplyChanges replays all the changes since the beginning of times.
+// ApplyChanges replays all the changes since the last event applied, which is the
+// beginning of times unless the manager started from a snapshot.
 func (m *Manager) ApplyChanges() {
-	events, err := m.db.FindChanges(0, eventOpenAccount, eventTransaction)
-	if err != nil {
+	if err := m.catchUp(); err != nil {
 		panic(err)
 	}
-	for _, e := range events {
-		m.Apply(e)
+}
+
+// catchUp applies the changes which happened since the last event applied.
+func (m *Manager) catchUp() error {
+	it := m.db.Iterate(m.version, readBatch, replayed...)
+	for it.Next() {
+		m.Apply(it.Event())
 	}
+	return it.Err()
 }
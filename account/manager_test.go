@@ -1,30 +1,47 @@
 package account
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/fx"
+	"github.com/florhusq/digibank/money"
+	"github.com/florhusq/digibank/projection"
 	"github.com/stretchr/testify/assert"
 )
 
 func setup(t *testing.T) *Manager {
-	db, err := event.Open("")
+	manager, err := NewManager(event.NewMemoryStore())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	manager, err := NewManager(db)
+	return manager
+}
+
+// openSQLite opens a SQLite store in memory, for the tests which need more than
+// event.MemoryStore. The database is dropped at the end of the test.
+func openSQLite(t *testing.T, name string) *event.Storage {
+	db, err := event.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", name))
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	return manager
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
 }
 
 func Test_createAccount(t *testing.T) {
 	manager := setup(t)
 
-	accID, err := manager.createAccount("florimond")
+	accID, err := manager.createAccount(context.Background(), &OpenAccountCommand{Customer: "florimond"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,7 +58,7 @@ func Test_transfers(t *testing.T) {
 	openAccount1 := &OpenAccountCommand{
 		Customer: "florimond",
 	}
-	accFlorimondID, err := manager.Process(openAccount1)
+	accFlorimondID, err := manager.Process(context.Background(), openAccount1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -49,32 +66,32 @@ func Test_transfers(t *testing.T) {
 	// Deposit to this account
 	depositToFlo := &DepositCommand{
 		AccountTo: accFlorimondID,
-		Amount:    50.0,
+		Amount:    5000,
 	}
-	manager.Process(depositToFlo)
+	manager.Process(context.Background(), depositToFlo)
 
 	// Check the balance after this deposit
 	balance, err := manager.ViewBalance(accFlorimondID)
 	assert.Nil(t, err)
-	assert.Equal(t, 50.0, balance)
+	assert.Equal(t, money.Amount(5000), balance)
 
 	// Withdraw from thia account
 	withdrawFlo := &WithdrawCommand{
 		AccountFrom: accFlorimondID,
-		Amount:      25.0,
+		Amount:      2500,
 	}
-	manager.Process(withdrawFlo)
+	manager.Process(context.Background(), withdrawFlo)
 
 	// Check the balance after this withdrawal
 	balance, err = manager.ViewBalance(accFlorimondID)
 	assert.Nil(t, err)
-	assert.Equal(t, 25.0, balance)
+	assert.Equal(t, money.Amount(2500), balance)
 
 	// Create another account for a transfer
 	openAccount := &OpenAccountCommand{
 		Customer: "emilie",
 	}
-	accEmilieID, err := manager.Process(openAccount)
+	accEmilieID, err := manager.Process(context.Background(), openAccount)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,16 +100,810 @@ func Test_transfers(t *testing.T) {
 	transferToEmi := &TransferCommand{
 		AccountFrom: accFlorimondID,
 		AccountTo:   accEmilieID,
-		Amount:      25,
+		Amount:      2500,
 	}
-	manager.Process(transferToEmi)
+	manager.Process(context.Background(), transferToEmi)
 
 	// Check the balance on both accounts.
 	balance, err = manager.ViewBalance(accFlorimondID)
 	assert.Nil(t, err)
-	assert.Equal(t, 0.0, balance)
+	assert.Equal(t, money.Amount(0), balance)
 
 	balance, err = manager.ViewBalance(accEmilieID)
 	assert.Nil(t, err)
-	assert.Equal(t, 25.0, balance)
+	assert.Equal(t, money.Amount(2500), balance)
+}
+
+func Test_concurrentWriters(t *testing.T) {
+	manager := setup(t)
+
+	accID, err := manager.Process(context.Background(), &OpenAccountCommand{Customer: "florimond"})
+	assert.Nil(t, err)
+	_, err = manager.Process(context.Background(), &DepositCommand{AccountTo: accID, Amount: 50})
+	assert.Nil(t, err)
+
+	// A second writer on the same store, which sees the same balance
+	other, err := NewManager(manager.db)
+	assert.Nil(t, err)
+
+	// Both writers try to withdraw the whole balance, only the first one succeeds
+	_, err = manager.Process(context.Background(), &WithdrawCommand{AccountFrom: accID, Amount: 50})
+	assert.Nil(t, err)
+	_, err = other.Process(context.Background(), &WithdrawCommand{AccountFrom: accID, Amount: 50})
+	assert.Equal(t, errInsufficientFunds, err)
+
+	// The second writer caught up with the first one
+	balance, err := other.ViewBalance(accID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(0), balance)
+
+	// And can still write to the stream
+	_, err = other.Process(context.Background(), &DepositCommand{AccountTo: accID, Amount: 10})
+	assert.Nil(t, err)
+}
+
+func Test_transferToAccountClosedMeanwhile(t *testing.T) {
+	manager := setup(t)
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	_, err := manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 5000})
+	assert.Nil(t, err)
+
+	// A second writer closes the receiving account, without touching the sending one
+	other, err := NewManager(manager.db)
+	assert.Nil(t, err)
+	_, err = other.Process(ctx, &CloseAccountCommand{AccountID: accEmilieID})
+	assert.Nil(t, err)
+
+	// The first writer sees the account was closed before transferring to it
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 2000})
+	assert.Equal(t, ErrClosed, err)
+
+	balance, err := manager.ViewBalance(accFlorimondID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(5000), balance)
+	assert.Empty(t, manager.quarantine)
+}
+
+func Test_writersOnOtherAccounts(t *testing.T) {
+	manager := setup(t)
+	ctx := context.Background()
+	accXID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accYID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+
+	// A second writer on the same store
+	other, err := NewManager(manager.db)
+	assert.Nil(t, err)
+
+	// Each writer appends to a different account, in turn
+	_, err = other.Process(ctx, &DepositCommand{AccountTo: accXID, Amount: 5000})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &DepositCommand{AccountTo: accYID, Amount: 2000})
+	assert.Nil(t, err)
+
+	// The first writer did not skip the deposit of the other one
+	balance, err := manager.ViewBalance(accXID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(5000), balance)
+
+	// And both can still write to the same account
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accXID, Amount: 1000})
+	assert.Nil(t, err)
+	_, err = other.Process(ctx, &TransferCommand{AccountFrom: accXID, AccountTo: accYID, Amount: 4000})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accXID, Amount: 1})
+	assert.Equal(t, errInsufficientFunds, err)
+
+	balance, err = other.ViewBalance(accYID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(6000), balance)
+	assert.Equal(t, manager.accounts, other.accounts)
+}
+
+func Test_viewTransactions(t *testing.T) {
+	manager := setup(t)
+
+	accFlorimondID, _ := manager.Process(context.Background(), &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(context.Background(), &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(context.Background(), &DepositCommand{AccountTo: accFlorimondID, Amount: 50})
+	manager.Process(context.Background(), &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 20})
+
+	// The transfer shows up in the history of both accounts
+	transactions, err := manager.ViewTransactions(accFlorimondID)
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 2)
+
+	transactions, err = manager.ViewTransactions(accEmilieID)
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, accFlorimondID, transactions[0].AccountFrom)
+	assert.Equal(t, money.Amount(20), transactions[0].Amount)
+
+	// Each transaction carries the metadata of the request which caused it
+	ctx := event.NewContext(context.Background(), event.Metadata{
+		CorrelationID: "correlation",
+		CausationID:   "request",
+		Actor:         "emilie",
+	})
+	_, err = manager.Process(ctx, &DepositCommand{AccountTo: accEmilieID, Amount: 5})
+	assert.Nil(t, err)
+	transactions, err = manager.ViewTransactions(accEmilieID)
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 2)
+	meta := transactions[1].Metadata()
+	assert.Equal(t, "request", meta.CausationID)
+	assert.Equal(t, "emilie", meta.Actor)
+	assert.False(t, meta.OccurredAt.IsZero())
+
+	// The receiving account can still be written to
+	_, err = manager.Process(context.Background(), &WithdrawCommand{AccountFrom: accEmilieID, Amount: 20})
+	assert.Nil(t, err)
+}
+
+func Test_stateAt(t *testing.T) {
+	manager := setup(t)
+
+	at := func(day int) context.Context {
+		return event.NewContext(context.Background(), event.Metadata{
+			OccurredAt: time.Date(2020, 1, day, 12, 0, 0, 0, time.UTC),
+		})
+	}
+	accID, _ := manager.Process(at(1), &OpenAccountCommand{Customer: "florimond"})
+	manager.Process(at(2), &DepositCommand{AccountTo: accID, Amount: 50})
+	manager.Process(at(3), &WithdrawCommand{AccountFrom: accID, Amount: 20})
+
+	// Up to an event
+	accounts, err := manager.StateAt(AsOf{EventID: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(50), accounts[accID].Amount)
+
+	// Up to a time
+	accounts, err = manager.StateAt(AsOf{Time: time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)})
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(0), accounts[accID].Amount)
+
+	accounts, err = manager.StateAt(AsOf{Time: time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)})
+	assert.Nil(t, err)
+	assert.NotContains(t, accounts, accID)
+
+	// A writer whose clock is behind appends an event with an earlier time
+	manager.Process(at(2), &DepositCommand{AccountTo: accID, Amount: 10})
+	accounts, err = manager.StateAt(AsOf{Time: time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)})
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(60), accounts[accID].Amount)
+
+	// The current state is untouched
+	balance, err := manager.ViewBalance(accID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(40), balance)
+	accounts, err = manager.StateAt(AsOf{})
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(40), accounts[accID].Amount)
+}
+
+func Test_history(t *testing.T) {
+	db := openSQLite(t, "manager-history")
+	manager, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := NewHistory(db.DB(), db, money.DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 50})
+	manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 20})
+	runner := projection.NewRunner(db, history)
+	assert.Nil(t, runner.CatchUp())
+
+	entries, err := history.View(accFlorimondID)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, DirectionIn, entries[0].Direction)
+	assert.Equal(t, "ATM", entries[0].Counterparty)
+	assert.Equal(t, money.Amount(50), entries[0].Balance)
+	assert.Equal(t, DirectionOut, entries[1].Direction)
+	assert.Equal(t, accEmilieID, entries[1].Counterparty)
+	assert.Equal(t, money.Amount(30), entries[1].Balance)
+	assert.Equal(t, uint(4), entries[1].EventID)
+
+	// Handling a transaction again does not record it twice
+	transactions, err := manager.ViewTransactions(accEmilieID)
+	assert.Nil(t, err)
+	assert.Nil(t, history.Handle(&transactions[0]))
+	entries, err = history.View(accEmilieID)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, money.Amount(20), entries[0].Balance)
+
+	// A history resuming from its checkpoint leaves out the quarantined transactions
+	resumed, err := NewHistory(db.DB(), db, money.DefaultCurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Append(&Transaction{AccountFrom: accEmilieID, AccountTo: "ATM", Amount: 30})
+	assert.Nil(t, err)
+	_, err = db.Append(&Transaction{AccountFrom: "unknown", AccountTo: accEmilieID, Amount: 30})
+	assert.Nil(t, err)
+	_, err = db.Append(&Transaction{AccountFrom: accEmilieID, AccountTo: "ATM", Amount: 5})
+	assert.Nil(t, err)
+	assert.Nil(t, projection.NewRunner(db, resumed).CatchUp())
+	entries, err = resumed.View(accEmilieID)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, money.Amount(15), entries[1].Balance)
+
+	// A rebuild gives the same history
+	assert.Nil(t, runner.Rebuild("history"))
+	rebuilt, err := history.View(accFlorimondID)
+	assert.Nil(t, err)
+	assert.Len(t, rebuilt, 2)
+	assert.Equal(t, money.Amount(30), rebuilt[1].Balance)
+	rebuilt, err = history.View(accEmilieID)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, rebuilt)
+}
+
+func Test_quarantine(t *testing.T) {
+	db := event.NewMemoryStore()
+	// Each event is appended to the stream of its account, as by the manager
+	for _, e := range []struct {
+		stream string
+		event  event.Event
+	}{
+		{"acc1", &OpenAccount{AccountID: "acc1", Customer: "florimond"}},
+		{"acc2", &OpenAccount{AccountID: "acc2", Customer: "emilie"}},
+		{"ghost", &Transaction{AccountFrom: "ghost", AccountTo: "acc2", Amount: 10}},
+		{"acc1", &Transaction{AccountFrom: "acc1", AccountTo: "ATM", Amount: 10}},
+		{"acc1", &OpenAccount{AccountID: "acc1", Customer: "emilie"}},
+		{"acc1", &Transaction{AccountFrom: "ATM", AccountTo: "acc1", Amount: 5}},
+		{"acc2", &Transaction{AccountFrom: "acc2", AccountTo: "ATM", Amount: -10}},
+	} {
+		assert.Nil(t, db.AppendExpectedStreams(e.stream, nil, e.event))
+	}
+
+	// Strict replay refuses to start
+	_, err := NewManager(db)
+	var quarantine *QuarantineError
+	if assert.True(t, errors.As(err, &quarantine)) {
+		assert.Equal(t, []Violation{
+			{EventID: 3, Reason: reasonUnknownAccount, Accounts: []string{"acc2"}},
+			{EventID: 4, Reason: reasonOverdrawn, Accounts: []string{"acc1"}},
+			{EventID: 5, Reason: reasonDuplicateAccount, Accounts: []string{"acc1"}},
+			{EventID: 7, Reason: reasonInvalidAmount, Accounts: []string{"acc2"}},
+		}, quarantine.Violations)
+	}
+
+	// Degraded replay freezes the accounts involved, skipping only the quarantined events
+	manager, err := NewManager(db, WithReplayMode(ReplayDegraded))
+	assert.Nil(t, err)
+	assert.Len(t, manager.Quarantine(), 4)
+	balance, err := manager.ViewBalance("acc1")
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(5), balance)
+	_, err = manager.Process(context.Background(), &DepositCommand{AccountTo: "acc1", Amount: 5})
+	assert.Equal(t, ErrQuarantined, err)
+
+	accID, _ := manager.Process(context.Background(), &OpenAccountCommand{Customer: "florimond"})
+	_, err = manager.Process(context.Background(), &DepositCommand{AccountTo: accID, Amount: 5})
+	assert.Nil(t, err)
+	_, err = manager.Process(context.Background(), &TransferCommand{AccountFrom: accID, AccountTo: "acc2", Amount: 5})
+	assert.Equal(t, ErrQuarantined, err)
+
+	// The quarantined events moved the versions of the accounts, so they can still be frozen
+	_, err = manager.Process(context.Background(), &FreezeAccountCommand{AccountID: "acc2"})
+	assert.Nil(t, err)
+	acc, err := manager.ViewAccount("acc2")
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFrozen, acc.Status)
+	assert.True(t, acc.Quarantined)
+}
+
+func Test_verify(t *testing.T) {
+	db := openSQLite(t, "manager-verify")
+	manager, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 50})
+	manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 20})
+	manager.Process(ctx, &WithdrawCommand{AccountFrom: accEmilieID, Amount: 5})
+
+	report, err := Verify(db, money.DefaultCurrency)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+	assert.Equal(t, 5, report.Events)
+	assert.Equal(t, 2, report.Accounts)
+	assert.Equal(t, &Totals{CashIn: 50, CashOut: 5, Balances: 45}, report.Currencies[money.DefaultCurrency])
+
+	// A withdrawal without the funds is reported, but as it moved no money the cash
+	// still adds up
+	_, err = db.Append(&Transaction{AccountFrom: accEmilieID, AccountTo: "ATM", Amount: 100})
+	assert.Nil(t, err)
+	report, err = Verify(db, money.DefaultCurrency)
+	assert.Nil(t, err)
+	assert.False(t, report.OK)
+	problems := []string{}
+	for _, issue := range report.Issues {
+		problems = append(problems, issue.Problem)
+	}
+	assert.Equal(t, []string{reasonOverdrawn}, problems)
+	assert.Equal(t, &Totals{CashIn: 50, CashOut: 5, Balances: 45}, report.Currencies[money.DefaultCurrency])
+}
+
+func Test_floatTransactions(t *testing.T) {
+	db := openSQLite(t, "manager-float")
+
+	// Transactions stored with float amounts, before version 2
+	legacy := `{"id":1,"name":"openAccount","stream":"acc1","schemaVersion":1,"data":{"account":"acc1","customer":"florimond"},"metadata":{}}
+{"id":2,"name":"transaction","stream":"acc1","schemaVersion":1,"data":{"from":"ATM","to":"acc1","amount":0.1},"metadata":{}}
+{"id":3,"name":"transaction","stream":"acc1","schemaVersion":1,"data":{"from":"ATM","to":"acc1","amount":0.2},"metadata":{}}
+{"id":4,"name":"transaction","stream":"acc1","schemaVersion":1,"data":{"from":"acc1","to":"ATM","amount":0.30000000000000004},"metadata":{}}
+`
+	assert.Nil(t, db.Import(strings.NewReader(legacy)))
+
+	manager, err := NewManager(db)
+	assert.Nil(t, err)
+	balance, err := manager.ViewBalance("acc1")
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(0), balance)
+
+	transactions, err := manager.ViewTransactions("acc1")
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(30), transactions[2].Amount)
+}
+
+func Test_currencies(t *testing.T) {
+	db := openSQLite(t, "manager-currencies")
+	rates, err := fx.NewTable("EUR", map[money.Currency]string{"USD": "1.25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := NewManager(db, WithRates(rates))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accEURID, err := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	assert.Nil(t, err)
+	accUSDID, err := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie", Currency: "USD"})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &OpenAccountCommand{Customer: "emilie", Currency: "usd"})
+	assert.Error(t, err)
+
+	// The transfer is converted, and records the rate and both amounts
+	manager.Process(ctx, &DepositCommand{AccountTo: accEURID, Amount: 1000})
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accEURID, AccountTo: accUSDID, Amount: 400})
+	assert.Nil(t, err)
+	acc, err := manager.ViewAccount(accUSDID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Currency("USD"), acc.Currency)
+	assert.Equal(t, money.Amount(500), acc.Amount)
+
+	transactions, err := manager.ViewTransactions(accUSDID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(400), transactions[0].Amount)
+	assert.Equal(t, money.Amount(500), transactions[0].AmountTo)
+	assert.Equal(t, "1.25000000", transactions[0].Rate.String())
+
+	// The money is conserved in each currency
+	report, err := Verify(db, money.DefaultCurrency)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+	assert.Equal(t, &Totals{CashIn: 1000, ExchangedOut: 400, Balances: 600}, report.Currencies["EUR"])
+	assert.Equal(t, &Totals{ExchangedIn: 500, Balances: 500}, report.Currencies["USD"])
+
+	// Without rates, the currencies can't be converted
+	withoutRates, err := NewManager(db)
+	assert.Nil(t, err)
+	_, err = withoutRates.Process(ctx, &TransferCommand{AccountFrom: accEURID, AccountTo: accUSDID, Amount: 100})
+	assert.Equal(t, errNoRates, err)
+}
+
+func Test_sweepWorthNothing(t *testing.T) {
+	db := openSQLite(t, "manager-sweep")
+	rates, err := fx.NewTable("EUR", map[money.Currency]string{"KWD": "0.33"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := NewManager(db, WithRates(rates))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accEURID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accKWDID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie", Currency: "KWD"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accEURID, Amount: 1})
+
+	// A cent is worth nothing once converted, so it can't be swept
+	_, err = manager.Process(ctx, &CloseAccountCommand{AccountID: accEURID, SweepTo: accKWDID})
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accEURID, AccountTo: accKWDID, Amount: 1})
+	assert.Equal(t, ErrInvalidAmount, err)
+
+	acc, err := manager.ViewAccount(accEURID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusOpen, acc.Status)
+	assert.Equal(t, money.Amount(1), acc.Amount)
+
+	// Nothing was quarantined, so a strict replay starts
+	_, err = NewManager(db, WithRates(rates))
+	assert.Nil(t, err)
+}
+
+func Test_lifecycle(t *testing.T) {
+	manager := setup(t)
+
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 50})
+
+	// A frozen account can't be operated on until it is unfrozen
+	_, err := manager.Process(ctx, &FreezeAccountCommand{AccountID: accFlorimondID, Reason: "fraud"})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 5})
+	assert.Equal(t, ErrFrozen, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accEmilieID, AccountTo: accFlorimondID, Amount: 5})
+	assert.Equal(t, ErrFrozen, err)
+	_, err = manager.Process(ctx, &CloseAccountCommand{AccountID: accFlorimondID})
+	assert.Equal(t, ErrFrozen, err)
+
+	_, err = manager.Process(ctx, &UnfreezeAccountCommand{AccountID: accFlorimondID})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &UnfreezeAccountCommand{AccountID: accFlorimondID})
+	assert.Equal(t, ErrNotFrozen, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 10})
+	assert.Nil(t, err)
+
+	// Closing requires the money left to be swept
+	_, err = manager.Process(ctx, &CloseAccountCommand{AccountID: accFlorimondID})
+	assert.Equal(t, ErrBalanceLeft, err)
+	_, err = manager.Process(ctx, &CloseAccountCommand{AccountID: accFlorimondID, SweepTo: accEmilieID})
+	assert.Nil(t, err)
+
+	acc, err := manager.ViewAccount(accFlorimondID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusClosed, acc.Status)
+	assert.Equal(t, money.Amount(0), acc.Amount)
+	balance, err := manager.ViewBalance(accEmilieID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(40), balance)
+
+	_, err = manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 5})
+	assert.Equal(t, ErrClosed, err)
+	_, err = manager.Process(ctx, &FreezeAccountCommand{AccountID: accFlorimondID})
+	assert.Equal(t, ErrClosed, err)
+
+	// The statuses are replayed
+	rebuilt, err := NewManager(manager.db)
+	assert.Nil(t, err)
+	assert.Equal(t, manager.accounts, rebuilt.accounts)
+}
+
+func Test_overdraft(t *testing.T) {
+	db := openSQLite(t, "manager-overdraft")
+	manager, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 50})
+
+	_, err = manager.Process(ctx, &SetOverdraftLimitCommand{AccountID: accFlorimondID, Limit: -10})
+	assert.Equal(t, errNegativeLimit, err)
+	_, err = manager.Process(ctx, &SetOverdraftLimitCommand{AccountID: accFlorimondID, Limit: 100})
+	assert.Nil(t, err)
+
+	// The account can go below zero, down to minus the limit
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 151})
+	assert.Equal(t, errInsufficientFunds, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 120})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 30})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 1})
+	assert.Equal(t, errInsufficientFunds, err)
+
+	acc, err := manager.ViewAccount(accFlorimondID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(-100), acc.Amount)
+	assert.Equal(t, money.Amount(100), acc.OverdraftLimit)
+	available, err := acc.Available()
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(0), available)
+
+	// The limit can't be lowered below what is already overdrawn
+	_, err = manager.Process(ctx, &SetOverdraftLimitCommand{AccountID: accFlorimondID, Limit: 50})
+	assert.Equal(t, errOverdrawn, err)
+	_, err = manager.Process(ctx, &CloseAccountCommand{AccountID: accFlorimondID, SweepTo: accEmilieID})
+	assert.Equal(t, ErrBalanceLeft, err)
+
+	// The limits are replayed
+	rebuilt, err := NewManager(db)
+	assert.Nil(t, err)
+	assert.Equal(t, manager.accounts, rebuilt.accounts)
+
+	report, err := Verify(db, money.DefaultCurrency)
+	assert.Nil(t, err)
+	assert.True(t, report.OK)
+}
+
+func Test_limits(t *testing.T) {
+	db := event.NewMemoryStore()
+
+	// Negative default limits would reject every transaction
+	_, err := NewManager(db, WithLimits(Limits{ChannelTransfer: {PerTransaction: -1}}))
+	assert.True(t, errors.Is(err, errInvalidLimit))
+
+	defaults := Limits{ChannelWithdrawal: {PerTransaction: 100, Daily: 150}}
+	manager, err := NewManager(db, WithLimits(defaults))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 1000})
+
+	// A negative amount can't get around the limits, nor any other amount moving no money
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: -500})
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: -500})
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 0})
+	assert.Equal(t, ErrInvalidAmount, err)
+
+	// The default limits apply per transaction and over 24 hours
+	var limitErr *LimitError
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 101})
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, &LimitError{Channel: ChannelWithdrawal, Cap: 100}, limitErr)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 100})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 60})
+	assert.Equal(t, &LimitError{Channel: ChannelWithdrawal, Cap: 150, Daily: true}, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accFlorimondID, Amount: 50})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 500})
+	assert.Nil(t, err)
+
+	// The limits of an account override the default ones
+	_, err = manager.Process(ctx, &SetLimitCommand{AccountID: accFlorimondID, Channel: "cheque", Limit: &Limit{}})
+	assert.Equal(t, errUnknownChannel, err)
+	_, err = manager.Process(ctx, &SetLimitCommand{AccountID: accFlorimondID, Channel: ChannelTransfer, Limit: &Limit{Daily: -1}})
+	assert.Equal(t, errInvalidLimit, err)
+	_, err = manager.Process(ctx, &SetLimitCommand{AccountID: accFlorimondID, Channel: ChannelTransfer, Limit: &Limit{Daily: 600}})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 200})
+	assert.Equal(t, &LimitError{Channel: ChannelTransfer, Cap: 600, Daily: true}, err)
+	_, err = manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 100})
+	assert.Nil(t, err)
+
+	// The money which left more than 24 hours ago does not count
+	yesterday := event.NewContext(ctx, event.Metadata{OccurredAt: time.Now().Add(-25 * time.Hour)})
+	_, err = manager.Process(yesterday, &WithdrawCommand{AccountFrom: accEmilieID, Amount: 100})
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &WithdrawCommand{AccountFrom: accEmilieID, Amount: 100})
+	assert.Nil(t, err)
+
+	// The limits are replayed
+	rebuilt, err := NewManager(db, WithLimits(defaults))
+	assert.Nil(t, err)
+	assert.Equal(t, manager.accounts, rebuilt.accounts)
+	_, err = rebuilt.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 1})
+	assert.Equal(t, &LimitError{Channel: ChannelTransfer, Cap: 600, Daily: true}, err)
+
+	// Without its own limit, the account falls back to the default one
+	_, err = rebuilt.Process(ctx, &SetLimitCommand{AccountID: accFlorimondID, Channel: ChannelTransfer})
+	assert.Nil(t, err)
+	_, err = rebuilt.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 1})
+	assert.Nil(t, err)
+}
+
+// fakeSnapshots is a snapshot store returning a fixed snapshot
+type fakeSnapshots struct {
+	version uint
+	state   snapshotState
+}
+
+func (f *fakeSnapshots) SaveSnapshot(name string, version uint, state interface{}) error {
+	return nil
+}
+
+func (f *fakeSnapshots) LoadSnapshot(name string, state interface{}) (uint, error) {
+	*state.(*snapshotState) = f.state
+	return f.version, nil
+}
+
+func Test_snapshots(t *testing.T) {
+	db := openSQLite(t, "manager-snapshots")
+	manager, err := NewManager(db, WithSnapshots(db, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accID, _ := manager.Process(context.Background(), &OpenAccountCommand{Customer: "florimond"})
+	manager.Process(context.Background(), &DepositCommand{AccountTo: accID, Amount: 50})
+	manager.Process(context.Background(), &WithdrawCommand{AccountFrom: accID, Amount: 20})
+	assert.NotEqual(t, uint(0), manager.snapshotVersion)
+
+	// A new manager starts from the snapshot and replays only the newer events
+	restored, err := NewManager(db, WithSnapshots(db, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, manager.version, restored.version)
+	balance, err := restored.ViewBalance(accID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(30), balance)
+
+	// A snapshot which does not match falls back to a full replay
+	mismatched, err := NewManager(db, WithSnapshots(&fakeSnapshots{
+		version: manager.version,
+		state: snapshotState{
+			Format:   snapshotFormat + 1,
+			Version:  manager.version,
+			Accounts: map[string]*Account{accID: {ID: accID, Amount: 1000}},
+		},
+	}, 2))
+	assert.Nil(t, err)
+	balance, err = mismatched.ViewBalance(accID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(30), balance)
+}
+
+func Test_exportImport(t *testing.T) {
+	db := openSQLite(t, "manager-export")
+	manager, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accFlorimondID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	accEmilieID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "emilie"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accFlorimondID, Amount: 50})
+	manager.Process(ctx, &TransferCommand{AccountFrom: accFlorimondID, AccountTo: accEmilieID, Amount: 20})
+
+	export := bytes.Buffer{}
+	assert.Nil(t, db.Export(&export, true))
+
+	// Replaying the export into an empty store rebuilds the same state
+	target := openSQLite(t, "manager-import")
+	assert.Nil(t, target.Import(&export))
+	rebuilt, err := NewManager(target)
+	assert.Nil(t, err)
+	assert.Equal(t, manager.accounts, rebuilt.accounts)
+	assert.Equal(t, manager.version, rebuilt.version)
+
+	transactions, err := rebuilt.ViewTransactions(accEmilieID)
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 1)
+}
+
+func Test_forgetCustomer(t *testing.T) {
+	db := openSQLite(t, "manager-forget")
+	manager, err := NewManager(db, WithSnapshots(db, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	accID, _ := manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+	manager.Process(ctx, &DepositCommand{AccountTo: accID, Amount: 50})
+	assert.Nil(t, manager.ForgetCustomer("florimond"))
+	assert.Equal(t, event.Redacted, manager.accounts[accID].Customer)
+
+	// Replaying shows the customer as redacted, and the balance is unchanged
+	replayed, err := NewManager(db)
+	assert.Nil(t, err)
+	assert.Equal(t, event.Redacted, replayed.accounts[accID].Customer)
+	balance, err := replayed.ViewBalance(accID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(50), balance)
+
+	// So does the snapshot
+	restored, err := NewManager(db, WithSnapshots(db, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, event.Redacted, restored.accounts[accID].Customer)
+
+	// The memory store keeps no personal data to erase
+	assert.Error(t, setup(t).ForgetCustomer("florimond"))
+}
+
+// publisher records the messages published by the outbox
+type publisher struct {
+	messages []event.Message
+}
+
+func (p *publisher) Publish(ctx context.Context, msg event.Message) error {
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func Test_publishedAccounts(t *testing.T) {
+	db := openSQLite(t, "manager-publish")
+	manager, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	manager.Process(ctx, &OpenAccountCommand{Customer: "florimond"})
+
+	// The customer is not published in clear, as it could not be forgotten there
+	published := &publisher{}
+	delivered, err := event.NewRelay(db, published).Deliver(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, eventOpenAccount, published.messages[0].Name)
+	assert.NotContains(t, string(published.messages[0].Data), "florimond")
+	assert.Contains(t, string(published.messages[0].Data), event.Redacted)
+}
+
+func Test_idempotency(t *testing.T) {
+	manager := setup(t)
+	ctx := context.Background()
+
+	// A retried opening returns the same account
+	open := &OpenAccountCommand{Idempotent: Idempotent{"open-1"}, Customer: "florimond"}
+	accID, err := manager.Process(ctx, open)
+	assert.Nil(t, err)
+	again, err := manager.Process(ctx, open)
+	assert.Nil(t, err)
+	assert.Equal(t, accID, again)
+	assert.Len(t, manager.accounts, 1)
+
+	// A retried deposit moves the money only once
+	deposit := &DepositCommand{Idempotent: Idempotent{"deposit-1"}, AccountTo: accID, Amount: 50}
+	for i := 0; i < 3; i++ {
+		_, err = manager.Process(ctx, deposit)
+		assert.Nil(t, err)
+	}
+	balance, err := manager.ViewBalance(accID)
+	assert.Nil(t, err)
+	assert.Equal(t, money.Amount(50), balance)
+
+	// Even if it was processed by another writer the manager did not catch up with
+	other, err := NewManager(manager.db)
+	assert.Nil(t, err)
+	withdraw := &WithdrawCommand{Idempotent: Idempotent{"withdraw-1"}, AccountFrom: accID, Amount: 50}
+	_, err = other.Process(ctx, withdraw)
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, withdraw)
+	assert.Nil(t, err)
+
+	transactions, err := manager.ViewTransactions(accID)
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 2)
+
+	// A key used again for a different command is rejected
+	_, err = manager.Process(ctx, &WithdrawCommand{Idempotent: Idempotent{"withdraw-1"}, AccountFrom: accID, Amount: 10})
+	assert.Equal(t, ErrKeyReused, err)
+	_, err = manager.Process(ctx, &DepositCommand{Idempotent: Idempotent{"withdraw-1"}, AccountTo: accID, Amount: 50})
+	assert.Equal(t, ErrKeyReused, err)
+	transactions, err = manager.ViewTransactions(accID)
+	assert.Nil(t, err)
+	assert.Len(t, transactions, 2)
+
+	// As is a key appended without the fingerprint of its command
+	unknown := &Transaction{AccountFrom: "ATM", AccountTo: accID, Amount: 50}
+	unknown.SetMetadata(event.Metadata{IdempotencyKey: "deposit-2"})
+	_, err = manager.db.Append(unknown)
+	assert.Nil(t, err)
+	_, err = manager.Process(ctx, &DepositCommand{Idempotent: Idempotent{"deposit-2"}, AccountTo: accID, Amount: 50})
+	assert.Equal(t, ErrKeyReused, err)
 }
@@ -0,0 +1,39 @@
+package account
+
+import (
+	"context"
+	"errors"
+
+	"github.com/florhusq/digibank/event"
+)
+
+var errNegativeLimit = errors.New("overdraft limit can't be negative")
+var errOverdrawn = errors.New("account is overdrawn beyond the new limit")
+
+// setOverdraftLimit is the command that changes how far below zero an account may go
+func (m *Manager) setOverdraftLimit(ctx context.Context, command *SetOverdraftLimitCommand) error {
+	if command.Limit < 0 {
+		return errNegativeLimit
+	}
+
+	return m.appendEvents(ctx, func() (*Account, []event.Event, error) {
+		acc, err := m.findAccount(command.AccountID)
+		if err != nil {
+			return nil, nil, errNoAccount
+		}
+		if acc.Status == StatusClosed {
+			return nil, nil, ErrClosed
+		}
+		if acc.Quarantined {
+			return nil, nil, ErrQuarantined
+		}
+		if acc.Amount < -command.Limit {
+			return nil, nil, errOverdrawn
+		}
+
+		return acc, []event.Event{&SetOverdraftLimit{
+			AccountID: acc.ID,
+			Limit:     command.Limit,
+		}}, nil
+	})
+}
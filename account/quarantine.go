@@ -0,0 +1,70 @@
+package account
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reasons why an event is quarantined
+const (
+	reasonUnknownAccount   = "unknown account"
+	reasonOverdrawn        = "overdrawn beyond the limit"
+	reasonDuplicateAccount = "duplicate account"
+	reasonOverflow         = "overflow"
+	reasonCurrencyMismatch = "currency mismatch"
+	reasonNotOpen          = "account not open"
+	reasonInvalidStatus    = "invalid status change"
+	reasonInvalidLimit     = "invalid limit"
+	reasonInvalidAmount    = "non-positive amount"
+)
+
+// Violation represents an event which breaks an invariant of the accounts. The event
+// is not applied, and the accounts involved are quarantined.
+type Violation struct {
+	EventID  uint     `json:"eventId"`  // The event which was not applied
+	Reason   string   `json:"reason"`   // The invariant which was broken
+	Accounts []string `json:"accounts"` // The accounts involved
+}
+
+// QuarantineError is returned when the manager refuses to start because events were
+// quarantined during the replay
+type QuarantineError struct {
+	Violations []Violation
+}
+
+// Error returns the error message
+func (e *QuarantineError) Error() string {
+	reasons := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		reasons = append(reasons, fmt.Sprintf("%d: %s", v.EventID, v.Reason))
+	}
+	return fmt.Sprintf("account: %d events quarantined (%s)", len(e.Violations), strings.Join(reasons, ", "))
+}
+
+// ReplayMode tells how the manager starts when events were quarantined
+type ReplayMode string
+
+// Supported ReplayModes
+const (
+	ReplayStrict   = ReplayMode("strict")   // Refuse to start
+	ReplayDegraded = ReplayMode("degraded") // Start with the accounts involved frozen
+)
+
+// WithReplayMode sets how the manager starts when events were quarantined. The
+// manager is strict by default.
+func WithReplayMode(mode ReplayMode) Option {
+	return func(m *Manager) {
+		if mode != "" {
+			m.replayMode = mode
+		}
+	}
+}
+
+// Quarantine returns the events which were not applied because they break an
+// invariant of the accounts
+func (m *Manager) Quarantine() []Violation {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]Violation{}, m.quarantine...)
+}
@@ -0,0 +1,95 @@
+package account
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	snapshotName   = "accounts"
+	snapshotFormat = 7 // Bumped whenever the layout of Account changes
+)
+
+// SnapshotStore represents a storage for the snapshots of the accounts
+type SnapshotStore interface {
+	SaveSnapshot(name string, version uint, state interface{}) error
+	LoadSnapshot(name string, state interface{}) (uint, error)
+}
+
+// snapshotState represents the accounts as saved in a snapshot
+type snapshotState struct {
+	Format   int                 `json:"format"`   // Layout of the snapshot
+	Version  uint                `json:"version"`  // ID of the last event applied
+	Accounts map[string]*Account `json:"accounts"` // The accounts by ID
+
+	Quarantine []Violation          `json:"quarantine"` // The events which were not applied
+	Outflows   map[string][]outflow `json:"outflows"`   // The money which left each account in the last 24 hours
+}
+
+// WithSnapshots makes the manager start from the latest snapshot, and save a new
+// one every interval events
+func WithSnapshots(store SnapshotStore, interval uint) Option {
+	return func(m *Manager) {
+		m.snapshots = store
+		m.snapshotInterval = interval
+	}
+}
+
+// restore loads the accounts from the latest snapshot
+func (m *Manager) restore() error {
+	state := snapshotState{}
+	version, err := m.snapshots.LoadSnapshot(snapshotName, &state)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case state.Format != snapshotFormat:
+		return fmt.Errorf("account: snapshot format %d, expected %d", state.Format, snapshotFormat)
+	case state.Version != version:
+		return fmt.Errorf("account: snapshot at version %d, saved as %d", state.Version, version)
+	}
+	for id, acc := range state.Accounts {
+		if acc == nil || acc.ID != id || acc.Version > version {
+			return fmt.Errorf("account: snapshot of account %s does not match", id)
+		}
+	}
+
+	m.accounts = state.Accounts
+	m.version = version
+	m.quarantine = state.Quarantine
+	m.outflows = state.Outflows
+	if m.outflows == nil {
+		m.outflows = make(map[string][]outflow)
+	}
+	m.snapshotVersion = version
+	return nil
+}
+
+// snapshot saves the accounts if enough events were applied since the latest snapshot.
+// A failure is only logged, as the events remain the source of truth.
+func (m *Manager) snapshot() {
+	if m.snapshots == nil || m.snapshotInterval == 0 || m.version < m.snapshotVersion+m.snapshotInterval {
+		return
+	}
+
+	if err := m.saveSnapshot(); err != nil {
+		log.Println("account: unable to save the snapshot:", err)
+	}
+}
+
+// saveSnapshot saves the accounts, replacing the latest snapshot
+func (m *Manager) saveSnapshot() error {
+	if err := m.snapshots.SaveSnapshot(snapshotName, m.version, &snapshotState{
+		Format:   snapshotFormat,
+		Version:  m.version,
+		Accounts: m.accounts,
+
+		Quarantine: m.quarantine,
+		Outflows:   m.outflows,
+	}); err != nil {
+		return err
+	}
+	m.snapshotVersion = m.version
+	return nil
+}
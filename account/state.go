@@ -0,0 +1,265 @@
+package account
+
+import (
+	"time"
+
+	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/money"
+)
+
+// replayed are the names of the events the accounts are rebuilt from
+var replayed = []string{eventOpenAccount, eventTransaction, eventFreeze, eventUnfreeze, eventClose, eventOverdraft, eventLimit}
+
+// state represents the accounts as rebuilt from the events
+type state struct {
+	accounts   map[string]*Account
+	version    uint                 // The ID of the last event applied
+	quarantine []Violation          // The events which were not applied
+	outflows   map[string][]outflow // The money which left each account in the last 24 hours
+
+	base money.Currency // The currency of the accounts opened without one
+}
+
+// newState creates the state before any event
+func newState(base money.Currency) state {
+	return state{
+		accounts: make(map[string]*Account, 0),
+		outflows: make(map[string][]outflow),
+		base:     base,
+	}
+}
+
+// findAccount finds an account baed on its ID.
+func (s *state) findAccount(ID string) (*Account, error) {
+	acc, ok := s.accounts[ID]
+	if !ok {
+		return nil, errNoAccount
+	}
+	return acc, nil
+}
+
+// apply applies an event to the accounts. An event which breaks an invariant is
+// quarantined instead of being applied.
+func (s *state) apply(e event.Event) {
+	switch e := e.(type) {
+	case *OpenAccount:
+		if acc, ok := s.accounts[e.AccountID]; ok {
+			s.quarantineEvent(e.EventID, reasonDuplicateAccount, acc)
+			break
+		}
+
+		currency := e.Currency
+		if currency == "" {
+			currency = s.base
+		}
+		s.accounts[e.AccountID] = &Account{
+			ID:       e.AccountID,
+			Customer: e.Customer,
+			Amount:   0,
+			Currency: currency,
+			Status:   StatusOpen,
+			Version:  e.EventID,
+		}
+	case *Transaction:
+		var accFrom, accTo *Account
+		var unknown bool
+		if e.AccountFrom != "ATM" {
+			accFrom = s.accounts[e.AccountFrom]
+			unknown = accFrom == nil
+		}
+		if e.AccountTo != "ATM" {
+			accTo = s.accounts[e.AccountTo]
+			unknown = unknown || accTo == nil
+		}
+
+		if unknown {
+			s.quarantineEvent(e.EventID, reasonUnknownAccount, accFrom, accTo)
+			break
+		}
+		if e.Amount <= 0 || e.Credited() <= 0 {
+			s.quarantineEvent(e.EventID, reasonInvalidAmount, accFrom, accTo)
+			break
+		}
+		if (accFrom != nil && accFrom.Status != StatusOpen) || (accTo != nil && accTo.Status != StatusOpen) {
+			s.quarantineEvent(e.EventID, reasonNotOpen, accFrom, accTo)
+			break
+		}
+		if accFrom != nil && accTo != nil && (accFrom.Currency != accTo.Currency) != (e.Rate != nil) {
+			s.quarantineEvent(e.EventID, reasonCurrencyMismatch, accFrom, accTo)
+			break
+		}
+		if accFrom != nil {
+			if available, err := accFrom.Available(); err != nil || available < e.Amount {
+				s.quarantineEvent(e.EventID, reasonOverdrawn, accFrom, accTo)
+				break
+			}
+		}
+
+		var amountFrom, amountTo money.Amount
+		var err error
+		if accFrom != nil {
+			amountFrom, err = accFrom.Amount.Sub(e.Amount)
+		}
+		if accTo != nil && err == nil {
+			amountTo, err = accTo.Amount.Add(e.Credited())
+		}
+		if err != nil {
+			s.quarantineEvent(e.EventID, reasonOverflow, accFrom, accTo)
+			break
+		}
+
+		if accFrom != nil {
+			accFrom.Amount = amountFrom
+			accFrom.Version = e.EventID
+			s.recordOutflow(accFrom.ID, channelOf(e), e.Amount, e.Metadata().OccurredAt)
+		}
+		if accTo != nil {
+			accTo.Amount = amountTo
+			accTo.Version = e.EventID
+		}
+	case *FreezeAccount:
+		s.changeStatus(e.EventID, e.AccountID, StatusOpen, StatusFrozen)
+	case *UnfreezeAccount:
+		s.changeStatus(e.EventID, e.AccountID, StatusFrozen, StatusOpen)
+	case *CloseAccount:
+		if acc, ok := s.accounts[e.AccountID]; ok && acc.Amount != 0 {
+			s.quarantineEvent(e.EventID, reasonInvalidStatus, acc)
+			break
+		}
+		s.changeStatus(e.EventID, e.AccountID, StatusOpen, StatusClosed)
+	case *SetOverdraftLimit:
+		acc, ok := s.accounts[e.AccountID]
+		switch {
+		case !ok:
+			s.quarantineEvent(e.EventID, reasonUnknownAccount)
+		case acc.Status == StatusClosed:
+			s.quarantineEvent(e.EventID, reasonNotOpen, acc)
+		case e.Limit < 0:
+			s.quarantineEvent(e.EventID, reasonInvalidLimit, acc)
+		case acc.Amount < -e.Limit:
+			s.quarantineEvent(e.EventID, reasonOverdrawn, acc)
+		default:
+			acc.OverdraftLimit = e.Limit
+			acc.Version = e.EventID
+		}
+	case *SetLimit:
+		acc, ok := s.accounts[e.AccountID]
+		switch {
+		case !ok:
+			s.quarantineEvent(e.EventID, reasonUnknownAccount)
+		case acc.Status == StatusClosed:
+			s.quarantineEvent(e.EventID, reasonNotOpen, acc)
+		case e.Limit != nil && !e.Limit.valid():
+			s.quarantineEvent(e.EventID, reasonInvalidLimit, acc)
+		case e.Limit == nil:
+			delete(acc.Limits, e.Channel)
+			acc.Version = e.EventID
+		default:
+			if acc.Limits == nil {
+				acc.Limits = make(Limits)
+			}
+			acc.Limits[e.Channel] = *e.Limit
+			acc.Version = e.EventID
+		}
+	}
+	s.version = event.IDOf(e)
+}
+
+// recordOutflow records money which left an account, forgetting what left it more than
+// 24 hours before
+func (s *state) recordOutflow(accountID string, channel Channel, amount money.Amount, at time.Time) {
+	since := at.Add(-window)
+	kept := []outflow{}
+	for _, out := range s.outflows[accountID] {
+		if out.At.After(since) {
+			kept = append(kept, out)
+		}
+	}
+	s.outflows[accountID] = append(kept, outflow{At: at, Channel: channel, Amount: amount})
+}
+
+// quarantined tells if an event was quarantined instead of being applied
+func (s *state) quarantined(eventID uint) bool {
+	for i := len(s.quarantine) - 1; i >= 0; i-- {
+		if s.quarantine[i].EventID == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// changeStatus moves an account from a status to another, quarantining the event if
+// the account is not at the expected status
+func (s *state) changeStatus(eventID uint, accountID string, from, to Status) {
+	acc, ok := s.accounts[accountID]
+	switch {
+	case !ok:
+		s.quarantineEvent(eventID, reasonUnknownAccount)
+	case acc.Status != from:
+		s.quarantineEvent(eventID, reasonInvalidStatus, acc)
+	default:
+		acc.Status = to
+		acc.Version = eventID
+	}
+}
+
+// quarantineEvent records an event which was not applied, and quarantines the known
+// accounts it involves. The event is still in the streams of the accounts, so their
+// versions move on.
+func (s *state) quarantineEvent(eventID uint, reason string, accounts ...*Account) {
+	violation := Violation{EventID: eventID, Reason: reason, Accounts: []string{}}
+	for _, acc := range accounts {
+		if acc != nil {
+			acc.Quarantined = true
+			acc.Version = eventID
+			violation.Accounts = append(violation.Accounts, acc.ID)
+		}
+	}
+	s.quarantine = append(s.quarantine, violation)
+}
+
+// AsOf represents a point in the history of the bank: the state after an event, or
+// at a time. The zero value is the current state.
+type AsOf struct {
+	EventID uint      // The last event included, if not 0
+	Time    time.Time // The time up to which events are included, if not zero
+}
+
+// after tells if an event, and the ones following it, are after the point in the history
+func (a AsOf) after(e event.Event) bool {
+	return a.EventID != 0 && event.IDOf(e) > a.EventID
+}
+
+// includes tells if an event happened before the point in the history. The times of
+// the events are stamped by each writer, so they don't always follow the IDs.
+func (a AsOf) includes(e event.Event) bool {
+	if a.after(e) {
+		return false
+	}
+	return a.Time.IsZero() || !e.Metadata().OccurredAt.After(a.Time)
+}
+
+// StateAt rebuilds the accounts as they were at a point in the history. The live
+// state of the manager is left untouched.
+func (m *Manager) StateAt(asOf AsOf) (map[string]Account, error) {
+	past := newState(m.base)
+	it := m.db.Iterate(0, readBatch, replayed...)
+	for it.Next() {
+		if asOf.after(it.Event()) {
+			break
+		}
+		if !asOf.includes(it.Event()) {
+			continue
+		}
+		past.apply(it.Event())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	accounts := make(map[string]Account, len(past.accounts))
+	for id, acc := range past.accounts {
+		accounts[id] = *acc
+	}
+	return accounts, nil
+}
@@ -0,0 +1,154 @@
+package account
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/money"
+)
+
+// issueNotConserved is the problem reported when the balances do not add up, besides
+// the ones of event.Inspect and the quarantined events
+const issueNotConserved = "money not conserved"
+
+// Inspector represents an event source able to check its own records
+type Inspector interface {
+	registrar
+	Inspect(visit func(event.Event)) ([]event.Issue, error)
+}
+
+// Totals represents the flows of money of a currency
+type Totals struct {
+	CashIn       money.Amount `json:"cashIn"`       // Deposited through ATMs
+	CashOut      money.Amount `json:"cashOut"`      // Withdrawn through ATMs
+	ExchangedIn  money.Amount `json:"exchangedIn"`  // Converted from other currencies
+	ExchangedOut money.Amount `json:"exchangedOut"` // Converted to other currencies
+	Balances     money.Amount `json:"balances"`     // Sum of the balances of the accounts
+}
+
+// net returns the money which should be on the accounts given the flows
+func (t *Totals) net() (money.Amount, error) {
+	net, err := t.CashIn.Sub(t.CashOut)
+	if err == nil {
+		net, err = net.Add(t.ExchangedIn)
+	}
+	if err == nil {
+		net, err = net.Sub(t.ExchangedOut)
+	}
+	return net, err
+}
+
+// Report represents the result of the verification of the whole bank
+type Report struct {
+	CheckedAt  time.Time                  `json:"checkedAt"`  // When the verification ran
+	Events     int                        `json:"events"`     // Number of events replayed
+	Accounts   int                        `json:"accounts"`   // Number of accounts rebuilt
+	Currencies map[money.Currency]*Totals `json:"currencies"` // The flows of money by currency
+	Issues     []event.Issue              `json:"issues"`     // The problems found
+	OK         bool                       `json:"ok"`         // Whether no problem was found
+}
+
+// totals returns the totals of a currency
+func (r *Report) totals(currency money.Currency) *Totals {
+	if _, ok := r.Currencies[currency]; !ok {
+		r.Currencies[currency] = &Totals{}
+	}
+	return r.Currencies[currency]
+}
+
+// count adds the flows of a transaction which was applied to the totals
+func (r *Report) count(s *state, t *Transaction) error {
+	add := func(sum *money.Amount, amount money.Amount) (err error) {
+		*sum, err = sum.Add(amount)
+		return err
+	}
+
+	from, to := s.accounts[t.AccountFrom], s.accounts[t.AccountTo]
+	switch {
+	case t.AccountFrom == "ATM" && to != nil:
+		return add(&r.totals(to.Currency).CashIn, t.Amount)
+	case t.AccountTo == "ATM" && from != nil:
+		return add(&r.totals(from.Currency).CashOut, t.Amount)
+	case from != nil && to != nil && from.Currency != to.Currency:
+		if err := add(&r.totals(from.Currency).ExchangedOut, t.Amount); err != nil {
+			return err
+		}
+		return add(&r.totals(to.Currency).ExchangedIn, t.Credited())
+	}
+	return nil
+}
+
+// Verify replays all of the events of a store and checks that they can be replayed,
+// that no account is overdrawn beyond its limit, and that in each currency the money on the accounts
+// is the money which came in through the ATMs or from other currencies, minus the money
+// which went out. base is the currency of the accounts opened without one.
+func Verify(db Inspector, base money.Currency) (*Report, error) {
+	register(db)
+
+	report := &Report{
+		CheckedAt:  time.Now().UTC(),
+		Currencies: make(map[money.Currency]*Totals),
+	}
+	replay := newState(base)
+	var overflow error
+	issues, err := db.Inspect(func(e event.Event) {
+		report.Events++
+		quarantined := len(replay.quarantine)
+		replay.apply(e)
+		// The quarantined transactions moved no money
+		if t, ok := e.(*Transaction); ok && overflow == nil && len(replay.quarantine) == quarantined {
+			overflow = report.count(&replay, t)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if overflow != nil {
+		return nil, overflow
+	}
+	report.Issues = issues
+
+	// The quarantined events were not applied
+	for _, v := range replay.quarantine {
+		report.Issues = append(report.Issues, event.Issue{
+			EventID: v.EventID,
+			Problem: v.Reason,
+			Detail:  fmt.Sprintf("accounts %v", v.Accounts),
+		})
+	}
+
+	for _, acc := range replay.accounts {
+		totals := report.totals(acc.Currency)
+		if totals.Balances, err = totals.Balances.Add(acc.Amount); err != nil {
+			return nil, err
+		}
+		if available, err := acc.Available(); err != nil || available < 0 {
+			report.Issues = append(report.Issues, event.Issue{
+				EventID: acc.Version,
+				Problem: reasonOverdrawn,
+				Detail:  fmt.Sprintf("account %s is at %v, with an overdraft of %v", acc.ID, acc.Amount, acc.OverdraftLimit),
+			})
+		}
+	}
+	report.Accounts = len(replay.accounts)
+
+	currencies := make([]string, 0, len(report.Currencies))
+	for currency := range report.Currencies {
+		currencies = append(currencies, string(currency))
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		totals := report.Currencies[money.Currency(currency)]
+		if net, err := totals.net(); err != nil || net != totals.Balances {
+			report.Issues = append(report.Issues, event.Issue{
+				Problem: issueNotConserved,
+				Detail:  fmt.Sprintf("the %s accounts hold %v but %v came in net", currency, totals.Balances, net),
+			})
+		}
+	}
+
+	report.OK = len(report.Issues) == 0
+	return report, nil
+}
@@ -29,6 +29,7 @@ type StorageType string
 // Supported StorageTypes types
 const (
 	SQLiteTypeMongo = StorageType("sqlite")
+	PostgresType    = StorageType("postgres")
 )
 
 // Storage configures the storage.
@@ -37,11 +38,56 @@ type Storage struct {
 	Connection string      `json:"connection" env:"DB_CONNECTION"`
 }
 
+// Snapshot configures the snapshots of the accounts.
+type Snapshot struct {
+	Interval uint `json:"interval" env:"SNAPSHOT_INTERVAL"` // Number of events between two snapshots, 0 disables them
+}
+
+// Replay configures how the service starts when events can't be replayed.
+type Replay struct {
+	Mode string `json:"mode" env:"REPLAY_MODE"` // "strict" refuses to start, "degraded" freezes the accounts involved
+}
+
+// Currency configures the currencies of the accounts.
+type Currency struct {
+	Base  string `json:"base" env:"CURRENCY_BASE"`   // The currency of the accounts opened without one, EUR if empty
+	Rates string `json:"rates" env:"CURRENCY_RATES"` // The file of the exchange rates, empty disables transfers between currencies
+}
+
+// Limits configures the default limits on the money leaving the accounts, as decimal
+// amounts in the currency of each account. Empty means no limit.
+type Limits struct {
+	Withdrawal      string `json:"withdrawal" env:"LIMIT_WITHDRAWAL"`            // Per ATM withdrawal
+	WithdrawalDaily string `json:"withdrawalDaily" env:"LIMIT_WITHDRAWAL_DAILY"` // ATM withdrawals over any 24 hours
+	Transfer        string `json:"transfer" env:"LIMIT_TRANSFER"`                // Per transfer
+	TransferDaily   string `json:"transferDaily" env:"LIMIT_TRANSFER_DAILY"`     // Transfers over any 24 hours
+}
+
+// PublisherType represents the way events are published to external consumers
+type PublisherType string
+
+// Supported PublisherTypes types
+const (
+	FilePublisher    = PublisherType("file")
+	WebhookPublisher = PublisherType("webhook")
+)
+
+// Outbox configures the publication of the events to external consumers.
+type Outbox struct {
+	Publisher PublisherType `json:"publisher" env:"OUTBOX_PUBLISHER"` // Empty disables the publication
+	Target    string        `json:"target" env:"OUTBOX_TARGET"`       // The file name or the URL of the webhook
+}
+
 // Config is the specific config to this service.
 // TODO user env here too, with custome setters, see doc.
 type Config struct {
 	Rest       Rest       `json:"rest"`
 	Storage    Storage    `json:"storage"`
+	Snapshot   Snapshot   `json:"snapshot"`
+	Replay     Replay     `json:"replay"`
+	Currency   Currency   `json:"currency"`
+	Limits     Limits     `json:"limits"`
+	Outbox     Outbox     `json:"outbox"`
 	Prometheus Prometheus `json:"prometheus"`
 }
 
@@ -14,6 +14,18 @@ func Test_Config_HappyPath(t *testing.T) {
 	assert.NotEmpty(t, cfg, "Config is empty.")
 }
 
+func Test_Config_Storage(t *testing.T) {
+	cfg, err := Load("sample_config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, SQLiteTypeMongo, cfg.Storage.Type)
+	assert.Equal(t, "file::memory:?cache=shared", cfg.Storage.Connection)
+
+	cfg, err = Load("sample_postgres_config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, PostgresType, cfg.Storage.Type)
+	assert.Contains(t, cfg.Storage.Connection, "dbname=digibank")
+}
+
 func Test_Config_FileDoesNotExist(t *testing.T) {
 	cfg, err := Load("")
 
@@ -0,0 +1,94 @@
+package event
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// verifyBatch is the number of records read at once while verifying the chain
+const verifyBatch = 500
+
+// ChainError reports the first record which breaks the hash chain
+type ChainError struct {
+	ID     uint   // The ID of the record
+	Reason string // Why the link is broken
+}
+
+// Error returns the error message
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("event: hash chain broken at %d: %s", e.ID, e.Reason)
+}
+
+// chain computes the hash of a record, which covers its payload, its metadata and
+// the hash of the previous record
+func (r *record) chain() string {
+	b, err := json.Marshal([]interface{}{
+		r.PrevHash,
+		r.ID,
+		r.Stream,
+		r.Name,
+		r.SchemaVersion,
+		r.OccurredAt.UTC().Format(time.RFC3339Nano),
+		r.CorrelationID,
+		r.CausationID,
+		r.Actor,
+		r.IdempotencyKey,
+		r.RequestHash,
+		r.Data,
+		r.KeyID,
+	})
+	if err != nil {
+		panic(err) // Only plain values are marshaled
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// last returns the ID and the hash of the last record, soft-deleted ones included,
+// or an empty record if the store is empty
+func (s *Storage) last(tx *gorm.DB) (record, error) {
+	last := record{}
+	err := tx.Unscoped().
+		Select("id", "hash").
+		Order("id DESC").
+		Limit(1).
+		Find(&last).Error
+	return last, err
+}
+
+// Verify walks the whole log and checks that no record was edited or deleted since
+// it was appended. A *ChainError reports the first broken link.
+func (s *Storage) Verify() error {
+	prev := record{}
+	for {
+		records := []record{}
+		if err := s.db.
+			Order("id").
+			Where("id > ?", prev.ID).
+			Limit(verifyBatch).
+			Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+
+		for _, r := range records {
+			switch {
+			case r.ID != prev.ID+1:
+				return &ChainError{ID: r.ID, Reason: fmt.Sprintf("record %d is missing", prev.ID+1)}
+			case r.PrevHash != prev.Hash:
+				return &ChainError{ID: r.ID, Reason: "previous hash does not match"}
+			case r.Hash != r.chain():
+				return &ChainError{ID: r.ID, Reason: "record was modified"}
+			}
+			prev = r
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package event
+
+// checkpoint represents the last event processed by a consumer of the store
+type checkpoint struct {
+	Name    string `gorm:"primarykey"` // Name of the consumer
+	EventID uint   // ID of the last event processed
+}
+
+// LoadCheckpoint returns the ID of the last event processed by a consumer, or 0 if
+// it did not process any
+func (s *Storage) LoadCheckpoint(name string) (uint, error) {
+	cp := checkpoint{}
+	if err := s.db.Where("name = ?", name).Limit(1).Find(&cp).Error; err != nil {
+		return 0, err
+	}
+	return cp.EventID, nil
+}
+
+// SaveCheckpoint saves the ID of the last event processed by a consumer
+func (s *Storage) SaveCheckpoint(name string, eventID uint) error {
+	return s.db.Save(&checkpoint{Name: name, EventID: eventID}).Error
+}
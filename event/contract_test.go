@@ -0,0 +1,289 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/stretchr/testify/assert"
+)
+
+// store is the behaviour every backend of the event store must share
+type store interface {
+	Append(event Event) (uint, error)
+	AppendAll(events ...Event) error
+	AppendExpected(stream string, expected uint, events ...Event) error
+	AppendExpectedStreams(stream string, expected map[string]uint, events ...Event) error
+	FindChanges(after uint, names ...string) ([]Event, error)
+	FindStream(stream string, after uint) ([]Event, error)
+	Register(name string, event Event)
+	Subscribe(ctx context.Context, after uint, names ...string) (<-chan Event, error)
+	Iterate(after uint, limit int, names ...string) *Iterator
+	IterateStream(stream string, after uint, limit int) *Iterator
+	FindIdempotent(key string) (Event, error)
+	LoadCheckpoint(name string) (uint, error)
+	SaveCheckpoint(name string, eventID uint) error
+}
+
+// iterate reads all the events of an iterator
+func iterate(t *testing.T, it *Iterator) []Event {
+	events := []Event{}
+	for it.Next() {
+		events = append(events, it.Event())
+	}
+	assert.NoError(t, it.Err())
+	return events
+}
+
+// owners describes events by their ID and owner, leaving the metadata aside
+func owners(events []Event) []string {
+	result := make([]string, 0, len(events))
+	for _, e := range events {
+		switch e := e.(type) {
+		case *AccountCreated:
+			result = append(result, fmt.Sprintf("%d:%s", e.EventID, e.Owner))
+		case *MoneySent:
+			result = append(result, fmt.Sprintf("%d:%s", e.EventID, e.From))
+		}
+	}
+	return result
+}
+
+// testContract runs the contract of the event store against a backend, open
+// returning an empty store
+func testContract(t *testing.T, open func(t *testing.T) store) {
+	t.Run("Append", func(t *testing.T) {
+		db := open(t)
+		first := &AccountCreated{Owner: "florimond"}
+		second := &AccountCreated{Owner: "emilie"}
+		id, err := db.Append(first)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(1), id)
+		_, err = db.Append(second)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(2), second.EventID)
+
+		changes, err := db.FindChanges(0, "account.created")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:florimond", "2:emilie"}, owners(changes))
+		assert.Equal(t, first.Metadata(), changes[0].Metadata())
+
+		changes, err = db.FindChanges(1, "account.created")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"2:emilie"}, owners(changes))
+
+		changes, err = db.FindChanges(0, "money.sent")
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("AppendAll", func(t *testing.T) {
+		db := open(t)
+		assert.NoError(t, db.AppendAll(&AccountCreated{Owner: "florimond"}, &AccountCreated{Owner: "emilie"}))
+
+		broken := &AccountCreated{Owner: "florimond"}
+		assert.Error(t, db.AppendAll(broken, &Broken{}))
+		assert.Equal(t, uint(0), broken.EventID)
+
+		changes, err := db.FindChanges(0, "account.created")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:florimond", "2:emilie"}, owners(changes))
+	})
+
+	t.Run("AppendExpected", func(t *testing.T) {
+		db := open(t)
+		assert.NoError(t, db.AppendExpected("alice", 0, &AccountCreated{Owner: "alice"}))
+		assert.NoError(t, db.AppendExpected("bob", 0, &AccountCreated{Owner: "bob"}))
+		assert.NoError(t, db.AppendExpected("alice", 1, &AccountCreated{Owner: "alice"}))
+
+		err := db.AppendExpected("alice", 1, &AccountCreated{Owner: "alice"})
+		assert.Equal(t, &ConflictError{Stream: "alice", Expected: 1, Actual: 3}, err)
+	})
+
+	t.Run("AppendExpectedStreams", func(t *testing.T) {
+		db := open(t)
+		assert.NoError(t, db.AppendExpected("alice", 0, &AccountCreated{Owner: "alice"}))
+		assert.NoError(t, db.AppendExpected("bob", 0, &AccountCreated{Owner: "bob"}))
+		assert.NoError(t, db.AppendExpectedStreams("alice", map[string]uint{"alice": 1, "bob": 2},
+			&MoneySent{From: "alice", To: "bob"}))
+
+		// The linked stream moved on, even though the stream appended to did not
+		assert.NoError(t, db.AppendExpected("bob", 3, &AccountCreated{Owner: "bob"}))
+		err := db.AppendExpectedStreams("alice", map[string]uint{"alice": 3, "bob": 3},
+			&MoneySent{From: "alice", To: "bob"})
+		assert.Equal(t, &ConflictError{Stream: "bob", Expected: 3, Actual: 4}, err)
+
+		events, err := db.FindStream("alice", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:alice", "3:alice"}, owners(events))
+	})
+
+	t.Run("FindStream", func(t *testing.T) {
+		db := open(t)
+		assert.NoError(t, db.AppendExpected("alice", 0, &MoneySent{From: "alice", To: "bob"}))
+		assert.NoError(t, db.AppendExpected("carol", 0, &MoneySent{From: "carol", To: "alice"}))
+
+		events, err := db.FindStream("alice", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:alice", "2:carol"}, owners(events))
+
+		events, err = db.FindStream("bob", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:alice"}, owners(events))
+
+		// Linked events move the version of the linked stream
+		err = db.AppendExpected("alice", 1, &MoneySent{From: "alice", To: "bob"})
+		assert.IsType(t, &ConflictError{}, err)
+	})
+
+	t.Run("Iterate", func(t *testing.T) {
+		db := open(t)
+		for _, owner := range []string{"alice", "bob", "carol", "dave", "erin"} {
+			assert.NoError(t, db.AppendExpected(owner, 0, &AccountCreated{Owner: owner}))
+		}
+		assert.NoError(t, db.AppendExpected("alice", 1, &MoneySent{From: "alice", To: "erin"}))
+
+		// Batches don't change the events read
+		for _, limit := range []int{1, 2, 5, 100} {
+			events := iterate(t, db.Iterate(1, limit, "account.created"))
+			assert.Equal(t, []string{"2:bob", "3:carol", "4:dave", "5:erin"}, owners(events))
+
+			events = iterate(t, db.IterateStream("erin", 0, limit))
+			assert.Equal(t, []string{"5:erin", "6:alice"}, owners(events))
+		}
+
+		assert.Empty(t, iterate(t, db.Iterate(6, 2, "account.created", "money.sent")))
+	})
+
+	t.Run("Idempotency", func(t *testing.T) {
+		db := open(t)
+		first := &AccountCreated{Owner: "florimond"}
+		first.SetMetadata(Metadata{IdempotencyKey: "key", RequestHash: "request"})
+		second := &AccountCreated{Owner: "florimond"}
+		second.SetMetadata(Metadata{IdempotencyKey: "key"})
+
+		assert.NoError(t, db.AppendExpected("florimond", 0, first))
+		assert.Equal(t, &DuplicateError{Key: "key", EventID: 1}, db.AppendAll(second))
+
+		found, err := db.FindIdempotent("key")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:florimond"}, owners([]Event{found}))
+		assert.Equal(t, "key", found.Metadata().IdempotencyKey)
+		assert.Equal(t, "request", found.Metadata().RequestHash)
+
+		found, err = db.FindIdempotent("other")
+		assert.NoError(t, err)
+		assert.Nil(t, found)
+	})
+
+	t.Run("ConcurrentAppendExpected", func(t *testing.T) {
+		db := open(t)
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		succeeded := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := db.AppendExpected("alice", 0, &AccountCreated{Owner: "alice"}); err == nil {
+					lock.Lock()
+					succeeded++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, succeeded)
+	})
+
+	t.Run("Subscribe", func(t *testing.T) {
+		db := open(t)
+		_, err := db.Append(&AccountCreated{Owner: "florimond"})
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := db.Subscribe(ctx, 0, "account.created")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1:florimond"}, owners([]Event{receive(t, events)}))
+
+		_, err = db.Append(&AccountCreated{Owner: "emilie"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"2:emilie"}, owners([]Event{receive(t, events)}))
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		db := open(t)
+		id, err := db.LoadCheckpoint("history")
+		assert.NoError(t, err)
+		assert.Equal(t, uint(0), id)
+
+		assert.NoError(t, db.SaveCheckpoint("history", 3))
+		assert.NoError(t, db.SaveCheckpoint("history", 5))
+		assert.NoError(t, db.SaveCheckpoint("totals", 1))
+		id, err = db.LoadCheckpoint("history")
+		assert.NoError(t, err)
+		assert.Equal(t, uint(5), id)
+	})
+}
+
+func TestSQLiteContract(t *testing.T) {
+	testContract(t, func(t *testing.T) store {
+		return openTest(t, t.Name())
+	})
+}
+
+func TestMemoryContract(t *testing.T) {
+	testContract(t, func(t *testing.T) store {
+		return NewMemoryStore()
+	})
+}
+
+// embeddedPort is the port of the PostgreSQL server started by the tests
+const embeddedPort = 54329
+
+// TestPostgresContract runs against the database of DIGIBANK_POSTGRES_DSN, whose
+// tables are emptied by the test. Without it, an embedded PostgreSQL server is
+// started, whose binaries are downloaded on the first run. The test is skipped if
+// they can't be, except in CI, where it fails instead.
+func TestPostgresContract(t *testing.T) {
+	dsn := os.Getenv("DIGIBANK_POSTGRES_DSN")
+	if dsn == "" {
+		dir, err := ioutil.TempDir("", "postgres")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		server := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Port(embeddedPort).
+			RuntimePath(dir).
+			Logger(ioutil.Discard))
+		if err := server.Start(); err != nil {
+			if os.Getenv("CI") != "" {
+				t.Fatal("unable to start an embedded PostgreSQL server:", err)
+			}
+			t.Skip("unable to start an embedded PostgreSQL server:", err)
+		}
+		defer server.Stop()
+		dsn = fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=postgres sslmode=disable", embeddedPort)
+	}
+
+	testContract(t, func(t *testing.T) store {
+		db, err := OpenPostgres(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Close()
+		})
+		if err := db.db.Exec("TRUNCATE records, links, snapshots, subject_keys, outbox_entries, checkpoints").Error; err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -2,6 +2,7 @@ package event
 
 import (
 	"encoding/json"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -10,11 +11,20 @@ import (
 type Event interface {
 	Name() string
 	SetEventID(uint)
+	Metadata() Metadata
+	SetMetadata(Metadata)
 }
 
-// ID represents an ID number
+// Linked represents an event which also belongs to other streams than the one
+// it is appended to, so it can be found from those streams too
+type Linked interface {
+	Links() []string
+}
+
+// ID represents an ID number, along with the metadata of the event
 type ID struct {
-	EventID uint `json:"-"`
+	EventID uint     `json:"-"`
+	Meta    Metadata `json:"-"`
 }
 
 // SetEventID assigns the ID of the event
@@ -22,27 +32,116 @@ func (id *ID) SetEventID(ID uint) {
 	id.EventID = ID
 }
 
+// eventID returns the ID of the event
+func (id *ID) eventID() uint {
+	return id.EventID
+}
+
+// IDOf returns the ID of an event, or 0 if the event does not embed ID
+func IDOf(e Event) uint {
+	if id, ok := e.(interface{ eventID() uint }); ok {
+		return id.eventID()
+	}
+	return 0
+}
+
+// Metadata returns the metadata of the event
+func (id *ID) Metadata() Metadata {
+	return id.Meta
+}
+
+// SetMetadata assigns the metadata of the event
+func (id *ID) SetMetadata(meta Metadata) {
+	id.Meta = meta
+}
+
 // Record represents an event stored in the database
 type record struct {
 	gorm.Model
-	Name string `gorm:"index"`      // Name/type of the event
-	Data []byte `gorm:"size:65536"` // JSON payload
+	Stream        string `gorm:"index"` // Stream/aggregate the event belongs to
+	Name          string `gorm:"index"` // Name/type of the event
+	SchemaVersion uint   // Version of the shape of the payload
+	Data          []byte `gorm:"size:65536"` // JSON payload
+	KeyID         string // Key encrypting the personal data of the payload, if any
+
+	OccurredAt    time.Time `gorm:"index"` // When the event happened
+	CorrelationID string    `gorm:"index"` // The conversation the event is part of
+	CausationID   string    // The request or event which caused the event
+	Actor         string    // The principal who caused the event
+
+	IdempotencyKey *string `gorm:"uniqueIndex"` // Key of the request which appended the event, if any
+	RequestHash    string  // Fingerprint of that request
+
+	PrevHash string // Hash of the previous record
+	Hash     string // Hash of this record, chained to the previous one
 }
 
-// Unmarshal unmarshals the value into the destination
-func (e *record) Unmarshal(dst Event) error {
-	return json.Unmarshal(e.Data, dst)
+// metadata returns the metadata of the record
+func (r *record) metadata() Metadata {
+	meta := Metadata{
+		OccurredAt:    r.OccurredAt.UTC(),
+		CorrelationID: r.CorrelationID,
+		CausationID:   r.CausationID,
+		Actor:         r.Actor,
+	}
+	if r.IdempotencyKey != nil {
+		meta.IdempotencyKey = *r.IdempotencyKey
+		meta.RequestHash = r.RequestHash
+	}
+	return meta
 }
 
-// newRecord creates a new event
-func newRecord(event Event) *record {
+// link represents the membership of an event in a stream
+type link struct {
+	ID      uint   `gorm:"primarykey"`
+	Stream  string `gorm:"index:idx_link_stream"` // Stream the event belongs to
+	EventID uint   `gorm:"index:idx_link_stream"` // ID of the record
+}
+
+// newLinks creates the links of an event appended to a stream
+func newLinks(stream string, event Event, eventID uint) []link {
+	links := []link{}
+	if stream != "" {
+		links = append(links, link{Stream: stream, EventID: eventID})
+	}
+	if linked, ok := event.(Linked); ok {
+		for _, other := range linked.Links() {
+			if other != stream {
+				links = append(links, link{Stream: other, EventID: eventID})
+			}
+		}
+	}
+	return links
+}
+
+// newRecord creates a new event in a stream
+func newRecord(stream string, event Event) (*record, error) {
 	b, err := json.Marshal(event)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	meta := event.Metadata()
+	if meta.OccurredAt.IsZero() {
+		meta.OccurredAt = time.Now()
 	}
 
-	return &record{
-		Name: event.Name(),
-		Data: b,
+	// Databases don't all keep nanoseconds
+	meta.OccurredAt = meta.OccurredAt.UTC().Truncate(time.Microsecond)
+
+	newRec := &record{
+		Stream:        stream,
+		Name:          event.Name(),
+		SchemaVersion: schemaVersion(event),
+		Data:          b,
+		OccurredAt:    meta.OccurredAt,
+		CorrelationID: meta.CorrelationID,
+		CausationID:   meta.CausationID,
+		Actor:         meta.Actor,
+	}
+	if meta.IdempotencyKey != "" {
+		newRec.IdempotencyKey = &meta.IdempotencyKey
+		newRec.RequestHash = meta.RequestHash
 	}
+	return newRec, nil
 }
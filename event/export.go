@@ -0,0 +1,197 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gorm.io/gorm"
+)
+
+// exportBatch is the number of records read at once during an export
+const exportBatch = 500
+
+// line represents an event in a JSON Lines export
+type line struct {
+	ID            uint            `json:"id"`
+	Name          string          `json:"name"`
+	Stream        string          `json:"stream,omitempty"`
+	Links         []string        `json:"links,omitempty"` // Streams the event is linked to
+	SchemaVersion uint            `json:"schemaVersion"`
+	Data          json.RawMessage `json:"data"`
+	KeyID         string          `json:"keyId,omitempty"` // Key of the personal data
+	Metadata      Metadata        `json:"metadata"`
+	Hash          string          `json:"hash,omitempty"` // Hash of the record in the chain
+}
+
+// keyLine represents the data key of a subject in a JSON Lines export
+type keyLine struct {
+	Key *subjectKey `json:"key"`
+}
+
+// Export writes all of the events of the store to w in JSON Lines, one event per
+// line in the order of their IDs. The personal data stays encrypted.
+//
+// With keys, the data keys of the subjects which were not forgotten come first, so
+// the personal data can still be read once imported. They are written in clear, along
+// with the subjects: forgetting a subject later does not erase its data from such an
+// export, which must then be destroyed too.
+func (s *Storage) Export(w io.Writer, keys bool) error {
+	enc := json.NewEncoder(w)
+
+	if keys {
+		subjectKeys := []subjectKey{}
+		if err := s.db.Order("id").Find(&subjectKeys).Error; err != nil {
+			return err
+		}
+		for i := range subjectKeys {
+			if err := enc.Encode(&keyLine{Key: &subjectKeys[i]}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for after := uint(0); ; {
+		records := []record{}
+		if err := s.db.
+			Order("id").
+			Where("id > ?", after).
+			Limit(exportBatch).
+			Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(records))
+		for _, r := range records {
+			ids = append(ids, r.ID)
+		}
+		links := []link{}
+		if err := s.db.Where("event_id IN ?", ids).Order("id").Find(&links).Error; err != nil {
+			return err
+		}
+		linked := make(map[uint][]string)
+		for _, l := range links {
+			linked[l.EventID] = append(linked[l.EventID], l.Stream)
+		}
+
+		for _, r := range records {
+			out := line{
+				ID:            r.ID,
+				Name:          r.Name,
+				Stream:        r.Stream,
+				SchemaVersion: r.SchemaVersion,
+				Data:          r.Data,
+				KeyID:         r.KeyID,
+				Metadata:      r.metadata(),
+				Hash:          r.Hash,
+			}
+			for _, stream := range linked[r.ID] {
+				if stream != r.Stream {
+					out.Links = append(out.Links, stream)
+				}
+			}
+			if err := enc.Encode(&out); err != nil {
+				return err
+			}
+		}
+		after = records[len(records)-1].ID
+	}
+}
+
+// Import appends the events exported in JSON Lines by Export. The IDs must follow
+// the last event of the store without any gap, so a whole export is imported into
+// an empty store. Nothing is imported if any line is rejected.
+func (s *Storage) Import(r io.Reader) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if s.serialize != nil {
+			if err := s.serialize(tx); err != nil {
+				return err
+			}
+		}
+
+		last, err := s.last(tx)
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for n := 1; scanner.Scan(); n++ {
+			key := keyLine{}
+			if err := json.Unmarshal(scanner.Bytes(), &key); err != nil {
+				return fmt.Errorf("event: line %d: %v", n, err)
+			}
+			if key.Key != nil {
+				if err := tx.Create(key.Key).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			in := line{}
+			if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+				return fmt.Errorf("event: line %d: %v", n, err)
+			}
+			if in.ID != last.ID+1 {
+				return fmt.Errorf("event: line %d: expected event %d, got %d", n, last.ID+1, in.ID)
+			}
+			if in.Name == "" || len(in.Data) == 0 {
+				return fmt.Errorf("event: line %d: event %d has no name or data", n, in.ID)
+			}
+
+			// The chain is rebuilt, and must match the one exported if any
+			meta := in.Metadata
+			newRec := &record{
+				Model:         gorm.Model{ID: in.ID},
+				Stream:        in.Stream,
+				Name:          in.Name,
+				SchemaVersion: in.SchemaVersion,
+				Data:          in.Data,
+				KeyID:         in.KeyID,
+				OccurredAt:    meta.OccurredAt,
+				CorrelationID: meta.CorrelationID,
+				CausationID:   meta.CausationID,
+				Actor:         meta.Actor,
+				PrevHash:      last.Hash,
+			}
+			if meta.IdempotencyKey != "" {
+				newRec.IdempotencyKey = &meta.IdempotencyKey
+				newRec.RequestHash = meta.RequestHash
+			}
+			newRec.Hash = newRec.chain()
+			if in.Hash != "" && in.Hash != newRec.Hash {
+				return fmt.Errorf("event: line %d: hash of event %d does not match", n, in.ID)
+			}
+			if err := tx.Create(newRec).Error; err != nil {
+				return err
+			}
+
+			links := []link{}
+			for _, stream := range append([]string{in.Stream}, in.Links...) {
+				if stream != "" {
+					links = append(links, link{Stream: stream, EventID: in.ID})
+				}
+			}
+			if len(links) > 0 {
+				if err := tx.Create(&links).Error; err != nil {
+					return err
+				}
+			}
+			last = *newRec
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notify()
+	return nil
+}
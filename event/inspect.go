@@ -0,0 +1,83 @@
+package event
+
+import (
+	"fmt"
+)
+
+// Problems found by Inspect
+const (
+	IssueUnknownName = "unknown name"
+	IssueUndecodable = "undecodable payload"
+	IssueGap         = "gap"
+	IssueDeleted     = "soft-deleted"
+	IssueChain       = "hash chain"
+)
+
+// Issue represents a problem found while checking the store
+type Issue struct {
+	EventID uint   `json:"eventId,omitempty"` // The event concerned, if any
+	Problem string `json:"problem"`           // What is wrong
+	Detail  string `json:"detail"`            // Why it is wrong
+}
+
+// Inspect walks all of the records, soft-deleted ones included, and reports the
+// ones which can't be replayed: gaps in the IDs, soft-deleted rows, names which were
+// not registered and payloads which can't be decoded, plus the first broken link of
+// the hash chain. The events which can be replayed are passed to visit, in order.
+func (s *Storage) Inspect(visit func(Event)) ([]Issue, error) {
+	issues := []Issue{}
+	var prev uint
+	for {
+		records := []record{}
+		if err := s.db.Unscoped().
+			Order("id").
+			Where("id > ?", prev).
+			Limit(verifyBatch).
+			Find(&records).Error; err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, r := range records {
+			if r.ID != prev+1 {
+				issues = append(issues, Issue{
+					EventID: r.ID,
+					Problem: IssueGap,
+					Detail:  fmt.Sprintf("records %d to %d are missing", prev+1, r.ID-1),
+				})
+			}
+			prev = r.ID
+
+			if r.DeletedAt.Valid {
+				issues = append(issues, Issue{
+					EventID: r.ID,
+					Problem: IssueDeleted,
+					Detail:  fmt.Sprintf("deleted at %s", r.DeletedAt.Time.UTC()),
+				})
+				continue
+			}
+
+			if _, err := s.makeEvent(&r); err != nil {
+				issues = append(issues, Issue{EventID: r.ID, Problem: IssueUnknownName, Detail: r.Name})
+				continue
+			}
+			events, err := s.makeEvents([]record{r})
+			if err != nil {
+				issues = append(issues, Issue{EventID: r.ID, Problem: IssueUndecodable, Detail: err.Error()})
+				continue
+			}
+			visit(events[0])
+		}
+	}
+
+	if err := s.Verify(); err != nil {
+		chain, ok := err.(*ChainError)
+		if !ok {
+			return nil, err
+		}
+		issues = append(issues, Issue{EventID: chain.ID, Problem: IssueChain, Detail: chain.Reason})
+	}
+	return issues, nil
+}
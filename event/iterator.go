@@ -0,0 +1,74 @@
+package event
+
+// Iterator reads events in batches, so that memory use stays bounded however long
+// the log is. It is used as follows:
+//
+//	it := db.Iterate(0, 100, "transaction")
+//	for it.Next() {
+//		e := it.Event()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator struct {
+	find       func(after uint, limit int) ([]record, error)
+	makeEvents func(records []record) ([]Event, error)
+	after      uint // The ID of the last record read
+	limit      int  // The size of a batch
+	batch      []Event
+	event      Event
+	done       bool
+	err        error
+}
+
+// newIterator creates an iterator reading limit records at once with find
+func newIterator(after uint, limit int,
+	find func(after uint, limit int) ([]record, error),
+	makeEvents func(records []record) ([]Event, error)) *Iterator {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &Iterator{
+		find:       find,
+		makeEvents: makeEvents,
+		after:      after,
+		limit:      limit,
+	}
+}
+
+// Next moves to the next event, reading the next batch if needed. It returns false
+// once all the events were read, or on error.
+func (it *Iterator) Next() bool {
+	if len(it.batch) == 0 && !it.done && it.err == nil {
+		records, err := it.find(it.after, it.limit)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.batch, it.err = it.makeEvents(records); it.err != nil {
+			return false
+		}
+
+		it.done = len(records) < it.limit
+		if len(records) > 0 {
+			it.after = records[len(records)-1].ID
+		}
+	}
+
+	if len(it.batch) == 0 {
+		it.event = nil
+		return false
+	}
+
+	it.event, it.batch = it.batch[0], it.batch[1:]
+	return true
+}
+
+// Event returns the current event
+func (it *Iterator) Event() Event {
+	return it.event
+}
+
+// Err returns the error which stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
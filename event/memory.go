@@ -0,0 +1,242 @@
+package event
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore is an event store kept in memory, with the same semantics as Storage.
+// Events are stored serialized, so they are read back as new instances, exactly as
+// from a database.
+type MemoryStore struct {
+	registry
+	hub
+	lock    sync.RWMutex
+	records []record          // The records, whose ID is their position + 1
+	links   map[string][]uint // The IDs of the events of each stream
+	keys    map[string]uint   // The first event appended with each idempotency key
+
+	checkpoints map[string]uint // The last event processed by each consumer
+}
+
+// NewMemoryStore creates an empty event store in memory
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		registry: newRegistry(),
+		hub:      newHub(),
+		links:    make(map[string][]uint),
+		keys:     make(map[string]uint),
+
+		checkpoints: make(map[string]uint),
+	}
+}
+
+// Append appends an event into the store
+func (s *MemoryStore) Append(event Event) (uint, error) {
+	ids, err := s.append("", nil, event)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// AppendAll appends several events into the store atomically: either all of them
+// are committed with contiguous IDs, or none is.
+func (s *MemoryStore) AppendAll(events ...Event) error {
+	_, err := s.append("", nil, events...)
+	return err
+}
+
+// AppendExpected appends events into a stream, provided that the stream is still at
+// the expected version. A *ConflictError is returned if the stream has moved on.
+func (s *MemoryStore) AppendExpected(stream string, expected uint, events ...Event) error {
+	return s.AppendExpectedStreams(stream, map[string]uint{stream: expected}, events...)
+}
+
+// AppendExpectedStreams appends events into a stream, provided that each stream of
+// expected is still at its version. A *ConflictError is returned for the first
+// stream which has moved on.
+func (s *MemoryStore) AppendExpectedStreams(stream string, expected map[string]uint, events ...Event) error {
+	_, err := s.append(stream, expected, events...)
+	return err
+}
+
+// append appends events to a stream, checking the versions of the expected streams
+func (s *MemoryStore) append(stream string, expected map[string]uint, events ...Event) ([]uint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := ""
+	if len(events) > 0 {
+		key = events[0].Metadata().IdempotencyKey
+		if id, ok := s.keys[key]; ok && key != "" {
+			return nil, &DuplicateError{Key: key, EventID: id}
+		}
+	}
+
+	for _, name := range streams(expected) {
+		if version := s.version(name); version != expected[name] {
+			return nil, &ConflictError{
+				Stream:   name,
+				Expected: expected[name],
+				Actual:   version,
+			}
+		}
+	}
+
+	// Build every record first, so nothing is stored if one of them fails
+	records := make([]record, 0, len(events))
+	for i, event := range events {
+		s.Register(event.Name(), event)
+		newRec, err := newRecord(stream, event)
+		if err != nil {
+			return nil, err
+		}
+		newRec.ID = uint(len(s.records) + i + 1)
+		if i > 0 {
+			newRec.IdempotencyKey, newRec.RequestHash = nil, ""
+		}
+		records = append(records, *newRec)
+	}
+
+	if key != "" {
+		s.keys[key] = records[0].ID
+	}
+
+	ids := make([]uint, 0, len(events))
+	for i, event := range events {
+		rec := records[i]
+		s.records = append(s.records, rec)
+		for _, l := range newLinks(stream, event, rec.ID) {
+			s.links[l.Stream] = append(s.links[l.Stream], l.EventID)
+		}
+
+		event.SetEventID(rec.ID)
+		event.SetMetadata(rec.metadata())
+		ids = append(ids, rec.ID)
+	}
+
+	s.notify()
+	return ids, nil
+}
+
+// version returns the ID of the last event of a stream
+func (s *MemoryStore) version(stream string) uint {
+	if ids := s.links[stream]; len(ids) > 0 {
+		return ids[len(ids)-1]
+	}
+	return 0
+}
+
+// FindIdempotent finds the first event appended with an idempotency key, or nil if
+// there is none
+func (s *MemoryStore) FindIdempotent(key string) (Event, error) {
+	s.lock.RLock()
+	id, ok := s.keys[key]
+	records := []record{}
+	if ok {
+		records = append(records, s.records[id-1])
+	}
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	events, err := s.makeEvents(records)
+	if err != nil {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+// FindChanges finds all of the changes after a certain key
+func (s *MemoryStore) FindChanges(after uint, names ...string) ([]Event, error) {
+	return s.makeEvents(s.find(after, 0, names))
+}
+
+// Iterate reads the changes after a certain key, limit events at once
+func (s *MemoryStore) Iterate(after uint, limit int, names ...string) *Iterator {
+	return newIterator(after, limit, func(after uint, limit int) ([]record, error) {
+		return s.find(after, limit, names), nil
+	}, s.makeEvents)
+}
+
+// find finds at most limit records after a certain key, or all of them if limit is 0
+func (s *MemoryStore) find(after uint, limit int, names []string) []record {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := []record{}
+	for i := int(after); i < len(s.records); i++ {
+		for _, name := range names {
+			if s.records[i].Name == name {
+				records = append(records, s.records[i])
+				break
+			}
+		}
+		if limit > 0 && len(records) == limit {
+			break
+		}
+	}
+	return records
+}
+
+// FindStream finds all of the events of a stream after a certain version, including
+// the ones linked to the stream
+func (s *MemoryStore) FindStream(stream string, after uint) ([]Event, error) {
+	return s.makeEvents(s.findStream(stream, after, 0))
+}
+
+// IterateStream reads the events of a stream after a certain version, limit events
+// at once
+func (s *MemoryStore) IterateStream(stream string, after uint, limit int) *Iterator {
+	return newIterator(after, limit, func(after uint, limit int) ([]record, error) {
+		return s.findStream(stream, after, limit), nil
+	}, s.makeEvents)
+}
+
+// findStream finds at most limit records of a stream after a certain version, or all
+// of them if limit is 0
+func (s *MemoryStore) findStream(stream string, after uint, limit int) []record {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := []record{}
+	for _, id := range s.links[stream] {
+		if id <= after {
+			continue
+		}
+		records = append(records, s.records[id-1])
+		if limit > 0 && len(records) == limit {
+			break
+		}
+	}
+	return records
+}
+
+// Subscribe delivers the events after a checkpoint, then the new ones as they are
+// appended, until the context is cancelled. The channel is closed when the
+// subscription ends.
+func (s *MemoryStore) Subscribe(ctx context.Context, after uint, names ...string) (<-chan Event, error) {
+	return s.subscribe(ctx, after, func(after uint, limit int) ([]record, error) {
+		return s.find(after, limit, names), nil
+	}, s.makeEvents)
+}
+
+// LoadCheckpoint returns the ID of the last event processed by a consumer, or 0 if
+// it did not process any
+func (s *MemoryStore) LoadCheckpoint(name string) (uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.checkpoints[name], nil
+}
+
+// SaveCheckpoint saves the ID of the last event processed by a consumer
+func (s *MemoryStore) SaveCheckpoint(name string, eventID uint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.checkpoints[name] = eventID
+	return nil
+}
@@ -0,0 +1,33 @@
+package event
+
+import (
+	"context"
+	"time"
+)
+
+// Metadata represents the context in which an event happened
+type Metadata struct {
+	OccurredAt    time.Time `json:"occurredAt"`    // When the event happened
+	CorrelationID string    `json:"correlationId"` // The conversation the event is part of
+	CausationID   string    `json:"causationId"`   // The request or event which caused the event
+	Actor         string    `json:"actor"`         // The principal who caused the event
+
+	// The key of the request which appended the event. An append is rejected with a
+	// *DuplicateError if an event was already appended with the same key.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	RequestHash    string `json:"requestHash,omitempty"` // Fingerprint of the request, to tell a retry from a reuse of the key
+}
+
+// metadataKey is the key of the metadata in a context
+type metadataKey struct{}
+
+// NewContext returns a context carrying the metadata of the events it causes
+func NewContext(ctx context.Context, meta Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, meta)
+}
+
+// FromContext returns the metadata carried by a context, if any
+func FromContext(ctx context.Context) Metadata {
+	meta, _ := ctx.Value(metadataKey{}).(Metadata)
+	return meta
+}
@@ -0,0 +1,176 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Message represents an event handed out to external consumers
+type Message struct {
+	ID       uint            `json:"id"`
+	Name     string          `json:"name"`
+	Stream   string          `json:"stream,omitempty"`
+	Data     json.RawMessage `json:"data"`
+	Metadata Metadata        `json:"metadata"`
+}
+
+// Publisher publishes messages to external consumers. A message may be published
+// more than once, so consumers must be idempotent, for instance on Message.ID.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// outboxEntry represents an event waiting to be published. The payload is read from
+// the record when publishing, so the outbox never holds personal data in clear.
+type outboxEntry struct {
+	ID            uint       `gorm:"primarykey"`
+	EventID       uint       `gorm:"uniqueIndex"` // The event to publish
+	Attempts      int        // Number of failed attempts
+	NextAttemptAt time.Time  `gorm:"index"` // When to try again
+	DeliveredAt   *time.Time `gorm:"index"` // When the event was published, if it was
+	LastError     string     // Why the last attempt failed
+}
+
+// Relay delivers the events of the outbox to a publisher, in order and at least once.
+// An event is tried again until it is published, holding back the ones after it.
+type Relay struct {
+	store      *Storage
+	publisher  Publisher
+	Interval   time.Duration // How often the outbox is polled, besides appends
+	Backoff    time.Duration // Delay after the first failure, doubled at each attempt
+	MaxBackoff time.Duration // Longest delay between two attempts
+	Batch      int           // Number of events delivered at once
+}
+
+// NewRelay creates a relay from the outbox of a store to a publisher
+func NewRelay(store *Storage, publisher Publisher) *Relay {
+	return &Relay{
+		store:      store,
+		publisher:  publisher,
+		Interval:   time.Second,
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Minute,
+		Batch:      100,
+	}
+}
+
+// Run delivers the events as they are appended, until the context is cancelled
+func (r *Relay) Run(ctx context.Context) error {
+	wake, stop := r.store.watch()
+	defer stop()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Deliver(ctx); err != nil && ctx.Err() == nil {
+			log.Println("event: outbox relay:", err)
+		}
+
+		select {
+		case <-wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Deliver publishes the pending events of the outbox and returns how many were
+// delivered. It stops at the first failure, so the events of a stream are published
+// in order, and the failed event is tried again after a backoff, however many times
+// it failed.
+func (r *Relay) Deliver(ctx context.Context) (int, error) {
+	s := r.store
+	delivered := 0
+	for {
+		entries := []outboxEntry{}
+		if err := s.db.
+			Where("delivered_at IS NULL").
+			Order("id").
+			Limit(r.Batch).
+			Find(&entries).Error; err != nil {
+			return delivered, err
+		}
+		if len(entries) == 0 {
+			return delivered, nil
+		}
+
+		for _, entry := range entries {
+			if entry.NextAttemptAt.After(time.Now()) {
+				return delivered, nil
+			}
+
+			err := r.publish(ctx, entry.EventID)
+			if err != nil {
+				entry.Attempts++
+				entry.NextAttemptAt = time.Now().Add(r.backoff(entry.Attempts))
+				entry.LastError = err.Error()
+				if err := s.db.Save(&entry).Error; err != nil {
+					return delivered, err
+				}
+				return delivered, err
+			}
+
+			now := time.Now()
+			entry.DeliveredAt = &now
+			if err := s.db.Save(&entry).Error; err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt to publish an event which failed
+// a number of times
+func (r *Relay) backoff(attempts int) time.Duration {
+	delay := r.Backoff
+	for i := 1; i < attempts && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	return delay
+}
+
+// publish publishes an event to the publisher
+func (r *Relay) publish(ctx context.Context, eventID uint) error {
+	records := []record{}
+	if err := r.store.db.Where("id = ?", eventID).Find(&records).Error; err != nil {
+		return err
+	}
+	// The personal data is not decrypted: once published, it could not be erased
+	events, err := r.store.registry.makeEvents(records)
+	if err != nil {
+		return err
+	}
+
+	// The event may be gone if the record was deleted
+	if len(events) == 0 {
+		return nil
+	}
+
+	redact(events[0])
+	data, err := json.Marshal(events[0])
+	if err != nil {
+		return err
+	}
+	return r.publisher.Publish(ctx, Message{
+		ID:       records[0].ID,
+		Name:     records[0].Name,
+		Stream:   records[0].Stream,
+		Data:     data,
+		Metadata: records[0].metadata(),
+	})
+}
+
+// enqueue adds an event to the outbox within the transaction appending it
+func enqueue(tx *gorm.DB, eventID uint) error {
+	return tx.Create(&outboxEntry{EventID: eventID}).Error
+}
@@ -0,0 +1,35 @@
+package event
+
+import (
+	"fmt"
+
+	"github.com/florhusq/digibank/config"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// appendLock is the key of the advisory lock held by the transactions appending
+// events in PostgreSQL
+const appendLock = 0x6469676962616e6b // "digibank"
+
+// New opens the storage configured
+func New(cfg config.Storage) (*Storage, error) {
+	switch cfg.Type {
+	case "", config.SQLiteTypeMongo:
+		return Open(cfg.Connection)
+	case config.PostgresType:
+		return OpenPostgres(cfg.Connection)
+	}
+
+	return nil, fmt.Errorf("event: unsupported storage type %s", cfg.Type)
+}
+
+// OpenPostgres opens a PostgreSQL database from its connection string
+func OpenPostgres(dsn string) (*Storage, error) {
+
+	// Appends hold a transaction-level advisory lock, so that the IDs are assigned and
+	// committed in order: a reader that saw an event never misses an earlier one.
+	return open(postgres.Open(dsn), func(tx *gorm.DB) error {
+		return tx.Exec("SELECT pg_advisory_xact_lock(?)", appendLock).Error
+	})
+}
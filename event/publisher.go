@@ -0,0 +1,105 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/florhusq/digibank/config"
+)
+
+// NewPublisher creates the publisher configured, or nil if none is
+func NewPublisher(cfg config.Outbox) (Publisher, error) {
+	switch cfg.Publisher {
+	case "":
+		return nil, nil
+	case config.FilePublisher:
+		return NewFilePublisher(cfg.Target), nil
+	case config.WebhookPublisher:
+		return NewWebhookPublisher(cfg.Target, nil), nil
+	}
+
+	return nil, fmt.Errorf("event: unsupported publisher %s", cfg.Publisher)
+}
+
+// FilePublisher publishes messages by appending them to a file in JSON Lines
+type FilePublisher struct {
+	lock sync.Mutex
+	name string
+}
+
+// NewFilePublisher creates a publisher appending to a file
+func NewFilePublisher(name string) *FilePublisher {
+	return &FilePublisher{name: name}
+}
+
+// Publish appends the message to the file, and syncs it to the disk
+func (p *FilePublisher) Publish(ctx context.Context, msg Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(p.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WebhookPublisher publishes messages by posting them in JSON to a URL
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookPublisher creates a publisher posting to a URL
+func NewWebhookPublisher(url string, client *http.Client) *WebhookPublisher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebhookPublisher{url: url, client: client}
+}
+
+// Publish posts the message, which is delivered once the webhook answers with a
+// 2xx status
+func (p *WebhookPublisher) Publish(ctx context.Context, msg Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("%d", msg.ID))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("event: webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// registry holds the types of events a store can create, and the upcasters of
+// their payloads
+type registry struct {
+	typesLock sync.RWMutex
+	types     map[string]reflect.Type
+	upcasters map[string]map[uint]Upcaster // Upcasters by event name and version
+}
+
+// newRegistry creates an empty registry
+func newRegistry() registry {
+	return registry{
+		types:     make(map[string]reflect.Type),
+		upcasters: make(map[string]map[uint]Upcaster),
+	}
+}
+
+// Register registers a type of event into the store so we can create it
+// while querying
+func (r *registry) Register(name string, event Event) {
+	r.typesLock.Lock()
+	defer r.typesLock.Unlock()
+
+	if _, ok := r.types[name]; !ok {
+		r.types[name] = reflect.TypeOf(event).Elem()
+	}
+}
+
+// makeEvent creates an instance of an event from a record
+func (r *registry) makeEvent(rec *record) (Event, error) {
+	r.typesLock.RLock()
+	defer r.typesLock.RUnlock()
+
+	if typ, ok := r.types[rec.Name]; ok {
+		return reflect.New(typ).Interface().(Event), nil
+	}
+
+	return nil, fmt.Errorf("event: unknown type %s", rec.Name)
+}
+
+// makeEvents convert records to events
+func (r *registry) makeEvents(records []record) ([]Event, error) {
+	result := make([]Event, 0, len(records))
+	for _, rec := range records {
+		event, err := r.makeEvent(&rec)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := r.upcast(&rec, schemaVersion(event))
+		if err != nil {
+			return nil, err
+		}
+
+		event.SetEventID(rec.ID)
+		event.SetMetadata(rec.metadata())
+		if err := json.Unmarshal(data, event); err != nil {
+			return nil, err
+		}
+
+		result = append(result, event)
+	}
+	return result, nil
+}
@@ -0,0 +1,199 @@
+package event
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Redacted replaces the personal fields of an event once its subject was forgotten
+const Redacted = "[redacted]"
+
+// sealedPrefix marks an encrypted personal field in a payload
+const sealedPrefix = "sealed:"
+
+// Personal represents an event holding personal data about a subject, such as a
+// customer. Its string fields tagged `personal:"true"` are encrypted with a key of
+// the subject, so they can be erased by destroying the key.
+type Personal interface {
+	Subject() string
+}
+
+// subjectKey represents the data key of a subject. The records only refer to the
+// random ID of the key, so once the key is destroyed nothing links them to the subject.
+type subjectKey struct {
+	ID      string `gorm:"primarykey" json:"id"` // Random, see newKeyID
+	Subject string `gorm:"index" json:"subject"` // The subject the key belongs to
+	Key     []byte `json:"key"`                  // AES-256 key
+}
+
+// newKeyID creates a random ID for the key of a subject
+func newKeyID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// personalFields returns the personal string fields of an event
+func personalFields(v reflect.Value) []reflect.Value {
+	fields := []reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("personal") == "true" && v.Field(i).Kind() == reflect.String {
+			fields = append(fields, v.Field(i))
+		}
+	}
+	return fields
+}
+
+// seal encrypts the personal fields of the payload of a record with the key of the
+// subject of the event, creating the key if needed
+func (s *Storage) seal(tx *gorm.DB, event Event, rec *record) error {
+	personal, ok := event.(Personal)
+	if !ok {
+		return nil
+	}
+
+	subject := personal.Subject()
+	key := subjectKey{}
+	if err := tx.Where("subject = ?", subject).Limit(1).Find(&key).Error; err != nil {
+		return err
+	}
+	if key.Key == nil {
+		id, err := newKeyID()
+		if err != nil {
+			return err
+		}
+		key = subjectKey{ID: id, Subject: subject, Key: make([]byte, 32)}
+		if _, err := rand.Read(key.Key); err != nil {
+			return err
+		}
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+	}
+
+	gcm, err := newGCM(key.Key)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt a copy, the event itself keeps the data in clear
+	sealed := reflect.New(reflect.TypeOf(event).Elem())
+	sealed.Elem().Set(reflect.ValueOf(event).Elem())
+	for _, field := range personalFields(sealed.Elem()) {
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		b := gcm.Seal(nonce, nonce, []byte(field.String()), nil)
+		field.SetString(sealedPrefix + base64.StdEncoding.EncodeToString(b))
+	}
+
+	if rec.Data, err = json.Marshal(sealed.Interface()); err != nil {
+		return err
+	}
+	rec.KeyID = key.ID
+	return nil
+}
+
+// unseal decrypts the personal fields of events read from records, or redacts them
+// if the key of their subject was destroyed
+func (s *Storage) unseal(records []record, events []Event) error {
+	ids := []string{}
+	for _, r := range records {
+		if r.KeyID != "" {
+			ids = append(ids, r.KeyID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	keys := []subjectKey{}
+	if err := s.db.Where("id IN ?", ids).Find(&keys).Error; err != nil {
+		return err
+	}
+	gcms := make(map[string]cipher.AEAD, len(keys))
+	for _, key := range keys {
+		gcm, err := newGCM(key.Key)
+		if err != nil {
+			return err
+		}
+		gcms[key.ID] = gcm
+	}
+
+	for i, r := range records {
+		if r.KeyID == "" {
+			continue
+		}
+
+		gcm, ok := gcms[r.KeyID]
+		for _, field := range personalFields(reflect.ValueOf(events[i]).Elem()) {
+			if !strings.HasPrefix(field.String(), sealedPrefix) {
+				continue
+			}
+			if !ok {
+				field.SetString(Redacted)
+				continue
+			}
+
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(field.String(), sealedPrefix))
+			if err != nil {
+				return fmt.Errorf("event: personal data of %d: %v", r.ID, err)
+			}
+			if len(b) < gcm.NonceSize() {
+				return fmt.Errorf("event: personal data of %d is truncated", r.ID)
+			}
+			clear, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+			if err != nil {
+				return fmt.Errorf("event: personal data of %d: %v", r.ID, err)
+			}
+			field.SetString(string(clear))
+		}
+	}
+	return nil
+}
+
+// redact replaces the personal fields of an event with Redacted, for the copies of the
+// event which can't be erased by destroying the key of its subject
+func redact(event Event) {
+	if _, ok := event.(Personal); !ok {
+		return
+	}
+	for _, field := range personalFields(reflect.ValueOf(event).Elem()) {
+		field.SetString(Redacted)
+	}
+}
+
+// newGCM creates the cipher of a key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Forget destroys the key of a subject. The personal data of the subject in the
+// events can no longer be read, and shows as Redacted.
+func (s *Storage) Forget(subject string) error {
+	tx := s.db.Where("subject = ?", subject).Delete(&subjectKey{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return errors.New("event: no personal data for this subject")
+	}
+	return nil
+}
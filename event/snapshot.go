@@ -0,0 +1,87 @@
+package event
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ErrNoSnapshot is returned when no snapshot was saved yet
+var ErrNoSnapshot = errors.New("event: no snapshot found")
+
+// snapshot represents a state saved at a certain event ID
+type snapshot struct {
+	gorm.Model
+	Name     string `gorm:"index"` // Name of the saved state
+	Version  uint   // ID of the last event applied to the state
+	Checksum string // SHA-256 of the payload
+	Data     []byte // JSON payload
+}
+
+// checksum computes the checksum of a payload
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveSnapshot saves a state which includes all the events up to a version, and
+// replaces the previous snapshot of the same name
+func (s *Storage) SaveSnapshot(name string, version uint, state interface{}) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("name = ?", name).Delete(&snapshot{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&snapshot{
+			Name:     name,
+			Version:  version,
+			Checksum: checksum(b),
+			Data:     b,
+		}).Error
+	})
+}
+
+// LoadSnapshot loads the latest snapshot of a state and returns the version it was
+// saved at. An error is returned if the snapshot is corrupt or does not match the
+// events in the store.
+func (s *Storage) LoadSnapshot(name string, state interface{}) (uint, error) {
+	snap := snapshot{}
+	if tx := s.db.
+		Where("name = ?", name).
+		Order("version DESC").
+		Limit(1).
+		Find(&snap); tx.Error != nil {
+		return 0, tx.Error
+	} else if tx.RowsAffected == 0 {
+		return 0, ErrNoSnapshot
+	}
+
+	if checksum(snap.Data) != snap.Checksum {
+		return 0, fmt.Errorf("event: snapshot %s is corrupt", name)
+	}
+
+	// The snapshot cannot include events which are not in the store
+	var last uint
+	if err := s.db.Unscoped().Model(&record{}).
+		Select("COALESCE(MAX(id), 0)").
+		Scan(&last).Error; err != nil {
+		return 0, err
+	}
+	if snap.Version > last {
+		return 0, fmt.Errorf("event: snapshot %s is at version %d but the store ends at %d", name, snap.Version, last)
+	}
+
+	if err := json.Unmarshal(snap.Data, state); err != nil {
+		return 0, err
+	}
+	return snap.Version, nil
+}
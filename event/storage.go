@@ -2,16 +2,54 @@ package event
 
 import (
 	"fmt"
-	"reflect"
+	"sort"
+	"sync"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// ConflictError is returned when a stream has moved on since the expected version
+type ConflictError struct {
+	Stream   string // The stream which moved on
+	Expected uint   // The version the writer expected
+	Actual   uint   // The version the stream actually is at
+}
+
+// Error returns the error message
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("event: stream %s is at version %d, expected %d", e.Stream, e.Actual, e.Expected)
+}
+
+// streams returns the streams of expected versions, in a stable order
+func streams(expected map[string]uint) []string {
+	names := make([]string, 0, len(expected))
+	for stream := range expected {
+		names = append(names, stream)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DuplicateError is returned when events were already appended with the same
+// idempotency key
+type DuplicateError struct {
+	Key     string // The idempotency key
+	EventID uint   // The first event appended with the key
+}
+
+// Error returns the error message
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("event: idempotency key %s was already used by %d", e.Key, e.EventID)
+}
+
 // Storage abstracts the event sourcing database
 type Storage struct {
-	db    *gorm.DB
-	types map[string]reflect.Type
+	registry
+	hub
+	lock      sync.Mutex
+	db        *gorm.DB
+	serialize func(tx *gorm.DB) error // Serializes the appends across processes
 }
 
 // Open opens the database
@@ -22,73 +60,281 @@ func Open(name string) (*Storage, error) {
 		name = "file::memory:?cache=shared"
 	}
 
-	// Open the SQLite database
-	db, err := gorm.Open(sqlite.Open(name), &gorm.Config{})
+	// Open the SQLite database. SQLite only has one writer at a time, and two processes
+	// appending the same ID collide on the primary key.
+	return open(sqlite.Open(name), nil)
+}
+
+// open opens the database with a dialect and the way appends are serialized
+func open(dialector gorm.Dialector, serialize func(tx *gorm.DB) error) (*Storage, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
 
-	db.AutoMigrate(&record{})
+	if err := db.AutoMigrate(&record{}, &link{}, &snapshot{}, &subjectKey{}, &outboxEntry{}, &checkpoint{}); err != nil {
+		return nil, err
+	}
 	return &Storage{
-		db:    db,
-		types: make(map[string]reflect.Type),
+		registry:  newRegistry(),
+		hub:       newHub(),
+		db:        db,
+		serialize: serialize,
 	}, nil
 }
 
+// DB returns the database of the store, in which read models can keep their own
+// tables next to the events
+func (s *Storage) DB() *gorm.DB {
+	return s.db
+}
+
+// Close closes the connections to the database. An in-memory SQLite database is
+// dropped with its last connection.
+func (s *Storage) Close() error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
 // Append appends an event into the store
 func (s *Storage) Append(event Event) (uint, error) {
-	s.Register(event.Name(), event)
-	newRec := newRecord(event)
-	err := s.db.Create(newRec).Error
-	event.SetEventID(newRec.ID)
-	return newRec.ID, err
+	ids, err := s.append("", nil, event)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// AppendAll appends several events into the store atomically: either all of them
+// are committed with contiguous IDs, or none is.
+func (s *Storage) AppendAll(events ...Event) error {
+	_, err := s.append("", nil, events...)
+	return err
+}
+
+// AppendExpected appends events into a stream, provided that the stream is still at
+// the expected version. The version of a stream is the ID of its last event, linked
+// ones included, or 0 if the stream is empty. A *ConflictError is returned if the
+// stream has moved on.
+func (s *Storage) AppendExpected(stream string, expected uint, events ...Event) error {
+	return s.AppendExpectedStreams(stream, map[string]uint{stream: expected}, events...)
+}
+
+// AppendExpectedStreams appends events into a stream, provided that each stream of
+// expected, such as the ones the events are linked to, is still at its version. A
+// *ConflictError is returned for the first stream which has moved on.
+func (s *Storage) AppendExpectedStreams(stream string, expected map[string]uint, events ...Event) error {
+	_, err := s.append(stream, func(tx *gorm.DB) error {
+		for _, name := range streams(expected) {
+			var version uint
+			if err := tx.Model(&link{}).
+				Select("COALESCE(MAX(event_id), 0)").
+				Where("stream = ?", name).
+				Scan(&version).Error; err != nil {
+				return err
+			}
+
+			if version != expected[name] {
+				return &ConflictError{
+					Stream:   name,
+					Expected: expected[name],
+					Actual:   version,
+				}
+			}
+		}
+		return nil
+	}, events...)
+	return err
+}
+
+// append inserts events and their links with contiguous IDs in a single transaction,
+// provided that check passes. The IDs are only assigned to the events once the
+// transaction is committed.
+func (s *Storage) append(stream string, check func(tx *gorm.DB) error, events ...Event) ([]uint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := make([]uint, 0, len(events))
+	records := make([]*record, 0, len(events))
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if s.serialize != nil {
+			if err := s.serialize(tx); err != nil {
+				return err
+			}
+		}
+
+		// The key of the first event identifies the whole append
+		if len(events) > 0 {
+			if key := events[0].Metadata().IdempotencyKey; key != "" {
+				if err := s.checkDuplicate(tx, key); err != nil {
+					return err
+				}
+			}
+		}
+
+		if check != nil {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+
+		// IDs of soft-deleted records are never reused
+		last, err := s.last(tx)
+		if err != nil {
+			return err
+		}
+
+		for i, event := range events {
+			s.Register(event.Name(), event)
+			newRec, err := newRecord(stream, event)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				newRec.IdempotencyKey, newRec.RequestHash = nil, ""
+			}
+			if err := s.seal(tx, event, newRec); err != nil {
+				return err
+			}
+
+			// Each record is chained to the previous one
+			newRec.ID = last.ID + 1
+			newRec.PrevHash = last.Hash
+			newRec.Hash = newRec.chain()
+			last = *newRec
+
+			if err := tx.Create(newRec).Error; err != nil {
+				return err
+			}
+
+			if links := newLinks(stream, event, newRec.ID); len(links) > 0 {
+				if err := tx.Create(&links).Error; err != nil {
+					return err
+				}
+			}
+			if err := enqueue(tx, newRec.ID); err != nil {
+				return err
+			}
+			ids = append(ids, newRec.ID)
+			records = append(records, newRec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, event := range events {
+		event.SetEventID(ids[i])
+		event.SetMetadata(records[i].metadata())
+	}
+	s.notify()
+	return ids, nil
+}
+
+// checkDuplicate returns a *DuplicateError if events were appended with a key
+func (s *Storage) checkDuplicate(tx *gorm.DB, key string) error {
+	first := record{}
+	if tx := tx.Unscoped().Select("id").Where("idempotency_key = ?", key).Limit(1).Find(&first); tx.Error != nil {
+		return tx.Error
+	} else if tx.RowsAffected > 0 {
+		return &DuplicateError{Key: key, EventID: first.ID}
+	}
+	return nil
+}
+
+// FindIdempotent finds the first event appended with an idempotency key, or nil if
+// there is none
+func (s *Storage) FindIdempotent(key string) (Event, error) {
+	records := []record{}
+	if err := s.db.Where("idempotency_key = ?", key).Limit(1).Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	events, err := s.makeEvents(records)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
 }
 
 // FindChanges finds all of the changes after a certain key
 func (s *Storage) FindChanges(after uint, names ...string) ([]Event, error) {
-	records := []record{}
-	if tx := s.db.Debug().
-		Order("id").
-		Where("name IN ? AND id > ?", names, after).
-		Find(&records); tx.Error != nil {
-		return nil, tx.Error
+	records, err := s.find(s.db.Debug(), after, 0, names)
+	if err != nil {
+		return nil, err
 	}
 
 	return s.makeEvents(records)
 }
 
-// Register registers a type of event into the store so we can create it
-// while querying
-func (s *Storage) Register(name string, event Event) {
-	if _, ok := s.types[name]; !ok {
-		s.types[name] = reflect.TypeOf(event).Elem()
-	}
+// Iterate reads the changes after a certain key, limit events at once
+func (s *Storage) Iterate(after uint, limit int, names ...string) *Iterator {
+	return newIterator(after, limit, func(after uint, limit int) ([]record, error) {
+		return s.find(s.db, after, limit, names)
+	}, s.makeEvents)
 }
 
-// makeEvent creates an instance of an event from a record
-func (s *Storage) makeEvent(r *record) (Event, error) {
-	if typ, ok := s.types[r.Name]; ok {
-		return reflect.New(typ).Interface().(Event), nil
+// find finds at most limit records after a certain key, or all of them if limit is 0
+func (s *Storage) find(db *gorm.DB, after uint, limit int, names []string) ([]record, error) {
+	query := db.
+		Order("id").
+		Where("name IN ? AND id > ?", names, after)
+	if limit > 0 {
+		query = query.Limit(limit)
 	}
 
-	return nil, fmt.Errorf("event: unknown type %s", r.Name)
+	records := []record{}
+	err := query.Find(&records).Error
+	return records, err
 }
 
-// makeEvents convert records to events
+// makeEvents converts records to events, with their personal data in clear
 func (s *Storage) makeEvents(records []record) ([]Event, error) {
-	result := make([]Event, 0, len(records))
-	for _, r := range records {
-		event, err := s.makeEvent(&r)
-		if err != nil {
-			return nil, err
-		}
+	events, err := s.registry.makeEvents(records)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.unseal(records, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
 
-		event.SetEventID(r.ID)
-		if err := r.Unmarshal(event); err != nil {
-			return nil, err
-		}
+// FindStream finds all of the events of a stream after a certain version, including
+// the ones linked to the stream
+func (s *Storage) FindStream(stream string, after uint) ([]Event, error) {
+	records, err := s.findStream(stream, after, 0)
+	if err != nil {
+		return nil, err
+	}
 
-		result = append(result, event)
+	return s.makeEvents(records)
+}
+
+// IterateStream reads the events of a stream after a certain version, limit events
+// at once
+func (s *Storage) IterateStream(stream string, after uint, limit int) *Iterator {
+	return newIterator(after, limit, func(after uint, limit int) ([]record, error) {
+		return s.findStream(stream, after, limit)
+	}, s.makeEvents)
+}
+
+// findStream finds at most limit records of a stream after a certain version, or all
+// of them if limit is 0
+func (s *Storage) findStream(stream string, after uint, limit int) ([]record, error) {
+	query := s.db.
+		Joins("JOIN links ON links.event_id = records.id").
+		Order("records.id").
+		Where("links.stream = ? AND records.id > ?", stream, after)
+	if limit > 0 {
+		query = query.Limit(limit)
 	}
-	return result, nil
+
+	records := []record{}
+	err := query.Find(&records).Error
+	return records, err
 }
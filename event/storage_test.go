@@ -1,7 +1,18 @@
 package event
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,9 +26,20 @@ func (e *AccountCreated) Name() string {
 	return "account.created"
 }
 
+// openTest opens a SQLite store in memory, dropped at the end of the test
+func openTest(t *testing.T, name string) *Storage {
+	db, err := Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
 func TestStorage(t *testing.T) {
-	db, err := Open("")
-	assert.NoError(t, err)
+	db := openTest(t, t.Name())
 
 	// Add few events into the storage
 	for i := 0; i < 10; i++ {
@@ -31,8 +53,531 @@ func TestStorage(t *testing.T) {
 	changes, err := db.FindChanges(8, "account.created")
 	assert.NoError(t, err)
 	assert.Len(t, changes, 2)
+	for _, change := range changes {
+		assert.False(t, change.Metadata().OccurredAt.IsZero())
+		change.SetMetadata(Metadata{})
+	}
+	assert.Equal(t, []Event{
+		&AccountCreated{Owner: "florimond", ID: ID{EventID: 9}},
+		&AccountCreated{Owner: "florimond", ID: ID{EventID: 10}},
+	}, changes)
+}
+
+func TestMetadata(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	meta := Metadata{
+		OccurredAt:    time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC),
+		CorrelationID: "correlation",
+		CausationID:   "request",
+		Actor:         "florimond",
+	}
+	event := &AccountCreated{Owner: "florimond"}
+	event.SetMetadata(meta)
+	id, err := db.Append(event)
+	assert.NoError(t, err)
+
+	changes, err := db.FindChanges(id-1, "account.created")
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, meta, changes[0].Metadata())
+
+	// Events without a time are stamped when appended
+	stamped := &AccountCreated{Owner: "emilie"}
+	_, err = db.Append(stamped)
+	assert.NoError(t, err)
+	assert.False(t, stamped.Metadata().OccurredAt.IsZero())
+}
+
+func TestAppendExpected(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	// Appending to an empty stream expects version 0
+	first := &AccountCreated{Owner: "florimond"}
+	assert.NoError(t, db.AppendExpected("stream-1", 0, first))
+	assert.NotEqual(t, uint(0), first.EventID)
+
+	// The stream is now at the ID of its last event
+	second := &AccountCreated{Owner: "emilie"}
+	assert.NoError(t, db.AppendExpected("stream-1", first.EventID, second))
+
+	// A writer which did not see the second event is rejected
+	err := db.AppendExpected("stream-1", first.EventID, &AccountCreated{Owner: "emilie"})
+	assert.Equal(t, &ConflictError{
+		Stream:   "stream-1",
+		Expected: first.EventID,
+		Actual:   second.EventID,
+	}, err)
+
+	// Other streams are not affected
+	assert.NoError(t, db.AppendExpected("stream-2", 0, &AccountCreated{Owner: "emilie"}))
+}
+
+type MoneySent struct {
+	ID
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (e *MoneySent) Name() string {
+	return "money.sent"
+}
+
+func (e *MoneySent) Links() []string {
+	return []string{e.To}
+}
+
+func TestFindStream(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	sent := &MoneySent{From: "alice", To: "bob"}
+	assert.NoError(t, db.AppendExpected("alice", 0, sent))
+
+	// The event is found from both streams
+	events, err := db.FindStream("alice", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{sent}, events)
+
+	events, err = db.FindStream("bob", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{sent}, events)
+
+	// The linked stream moved on as well
+	err = db.AppendExpected("bob", 0, &MoneySent{From: "bob", To: "alice"})
+	assert.IsType(t, &ConflictError{}, err)
+
+	events, err = db.FindStream("alice", sent.EventID)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+type Broken struct {
+	ID
+	Callback func() `json:"callback"`
+}
+
+func (e *Broken) Name() string {
+	return "broken"
+}
+
+func TestAppendAll(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	// All the events are committed with contiguous IDs
+	first := &AccountCreated{Owner: "florimond"}
+	second := &AccountCreated{Owner: "emilie"}
+	assert.NoError(t, db.AppendAll(first, second))
+	assert.NotEqual(t, uint(0), first.EventID)
+	assert.Equal(t, first.EventID+1, second.EventID)
+
+	// A failure rolls back every event of the batch
+	third := &AccountCreated{Owner: "florimond"}
+	assert.Error(t, db.AppendAll(third, &Broken{}))
+	assert.Equal(t, uint(0), third.EventID)
+
+	changes, err := db.FindChanges(second.EventID, "account.created", "broken")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestSnapshot(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	state := map[string]int{}
+	_, err := db.LoadSnapshot("test", &state)
+	assert.Equal(t, ErrNoSnapshot, err)
+
+	id, err := db.Append(&AccountCreated{Owner: "florimond"})
+	assert.NoError(t, err)
+	assert.NoError(t, db.SaveSnapshot("test", id, map[string]int{"florimond": 1}))
+
+	version, err := db.LoadSnapshot("test", &state)
+	assert.NoError(t, err)
+	assert.Equal(t, id, version)
+	assert.Equal(t, map[string]int{"florimond": 1}, state)
+
+	// A snapshot ahead of the store is rejected
+	assert.NoError(t, db.SaveSnapshot("test", id+100, state))
+	_, err = db.LoadSnapshot("test", &state)
+	assert.Error(t, err)
+
+	// So is a corrupt one
+	assert.NoError(t, db.SaveSnapshot("test", id, state))
+	db.db.Model(&snapshot{}).Where("name = ?", "test").Update("data", []byte(`{"emilie":2}`))
+	_, err = db.LoadSnapshot("test", &state)
+	assert.Error(t, err)
+}
+
+type Subscribed struct {
+	ID
+	Owner string `json:"owner"`
+}
+
+func (e *Subscribed) Name() string {
+	return "subscribed"
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	first := &Subscribed{Owner: "florimond"}
+	second := &Subscribed{Owner: "emilie"}
+	assert.NoError(t, db.AppendAll(first, second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := db.Subscribe(ctx, first.EventID, "subscribed")
+	assert.NoError(t, err)
+
+	// The backlog after the checkpoint is delivered first
+	assert.Equal(t, second, receive(t, events))
+
+	// Then the new events as they are appended
+	third := &Subscribed{Owner: "florimond"}
+	_, err = db.Append(third)
+	assert.NoError(t, err)
+	assert.Equal(t, third, receive(t, events))
+
+	// Cancelling closes the channel
+	cancel()
+	for range events {
+	}
+}
+
+// Deposited is at version 3: the amount was a float in version 1, then an integer
+// in cents in version 2, and the owner was renamed to holder in version 3
+type Deposited struct {
+	ID
+	Holder string `json:"holder"`
+	Cents  int64  `json:"cents"`
+}
+
+func (e *Deposited) Name() string {
+	return "deposited"
+}
+
+func (e *Deposited) SchemaVersion() uint {
+	return 3
+}
+
+func TestUpcast(t *testing.T) {
+	db := openTest(t, t.Name())
+
+	// Payloads stored by the former versions of the event
+	fixtures := []record{
+		{Name: "deposited", SchemaVersion: 1, Data: []byte(`{"owner":"florimond","amount":12.5}`)},
+		{Name: "deposited", SchemaVersion: 2, Data: []byte(`{"owner":"emilie","cents":300}`)},
+		{Name: "deposited", Data: []byte(`{"owner":"emilie","amount":0.1}`)}, // Before versioning
+	}
+	assert.NoError(t, db.db.Create(&fixtures).Error)
+
+	db.Register("deposited", &Deposited{})
+	db.Upcast("deposited", 1, func(data []byte) ([]byte, error) {
+		v1 := struct {
+			Owner  string  `json:"owner"`
+			Amount float64 `json:"amount"`
+		}{}
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]interface{}{
+			"owner": v1.Owner,
+			"cents": int64(v1.Amount*100 + 0.5),
+		})
+	})
+
+	// Without an upcaster for version 2, the events can't be read
+	_, err := db.FindChanges(0, "deposited")
+	assert.Error(t, err)
+
+	db.Upcast("deposited", 2, func(data []byte) ([]byte, error) {
+		v2 := map[string]interface{}{}
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return nil, err
+		}
+		v2["holder"] = v2["owner"]
+		delete(v2, "owner")
+		return json.Marshal(v2)
+	})
+
+	// Current events are stored at the current version
+	current := &Deposited{Holder: "florimond", Cents: 100}
+	_, err = db.Append(current)
+	assert.NoError(t, err)
+
+	changes, err := db.FindChanges(0, "deposited")
+	assert.NoError(t, err)
 	assert.Equal(t, []Event{
-		&AccountCreated{Owner: "florimond", ID: ID{9}},
-		&AccountCreated{Owner: "florimond", ID: ID{10}},
+		&Deposited{ID: ID{EventID: fixtures[0].ID}, Holder: "florimond", Cents: 1250},
+		&Deposited{ID: ID{EventID: fixtures[1].ID}, Holder: "emilie", Cents: 300},
+		&Deposited{ID: ID{EventID: fixtures[2].ID}, Holder: "emilie", Cents: 10},
+		current,
 	}, changes)
 }
+
+func TestExportImport(t *testing.T) {
+	source := openTest(t, "export-source")
+
+	sent := &MoneySent{From: "alice", To: "bob"}
+	sent.SetMetadata(Metadata{CorrelationID: "correlation", Actor: "alice"})
+	assert.NoError(t, source.AppendExpected("alice", 0, &AccountCreated{Owner: "alice"}))
+	assert.NoError(t, source.AppendExpected("alice", 1, sent))
+
+	export := bytes.Buffer{}
+	assert.NoError(t, source.Export(&export, true))
+	assert.Equal(t, 2, strings.Count(export.String(), "\n"))
+
+	target := openTest(t, "export-target")
+	assert.NoError(t, target.Import(strings.NewReader(export.String())))
+	target.Register("account.created", &AccountCreated{})
+	target.Register("money.sent", &MoneySent{})
+
+	// The events, their metadata and their streams are the same
+	events, err := target.FindStream("bob", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{sent}, events)
+
+	again := bytes.Buffer{}
+	assert.NoError(t, target.Export(&again, true))
+	assert.Equal(t, export.String(), again.String())
+
+	// The IDs no longer follow the store
+	assert.Error(t, target.Import(strings.NewReader(export.String())))
+}
+
+func TestExportKeys(t *testing.T) {
+	source := openTest(t, "export-keys")
+	assert.NoError(t, source.AppendAll(&CustomerJoined{Customer: "alice", Plan: "gold"}))
+
+	// Without the keys, the personal data can't be read from the export
+	export := bytes.Buffer{}
+	assert.NoError(t, source.Export(&export, false))
+	assert.NotContains(t, export.String(), "alice")
+	target := openTest(t, "export-keys-without")
+	assert.NoError(t, target.Import(&export))
+	target.Register("customer.joined", &CustomerJoined{})
+	changes, err := target.FindChanges(0, "customer.joined")
+	assert.NoError(t, err)
+	assert.Equal(t, &CustomerJoined{Customer: Redacted, Email: Redacted, Plan: "gold"}, plain(changes[0]))
+
+	// With them, it can
+	export.Reset()
+	assert.NoError(t, source.Export(&export, true))
+	assert.Contains(t, export.String(), "alice")
+	target = openTest(t, "export-keys-with")
+	assert.NoError(t, target.Import(&export))
+	target.Register("customer.joined", &CustomerJoined{})
+	changes, err = target.FindChanges(0, "customer.joined")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", changes[0].(*CustomerJoined).Customer)
+}
+
+func TestImportRejectsGaps(t *testing.T) {
+	db := openTest(t, "import-gaps")
+
+	err := db.Import(strings.NewReader(
+		`{"id":1,"name":"account.created","data":{"owner":"alice"}}` + "\n" +
+			`{"id":3,"name":"account.created","data":{"owner":"bob"}}` + "\n"))
+	assert.Error(t, err)
+
+	// Nothing was imported
+	export := bytes.Buffer{}
+	assert.NoError(t, db.Export(&export, true))
+	assert.Empty(t, export.String())
+}
+
+func TestVerify(t *testing.T) {
+	db := openTest(t, "verify")
+
+	// Concurrent writers keep the chain intact
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Append(&AccountCreated{Owner: "florimond"})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, db.Verify())
+
+	// An edited record is reported
+	db.db.Model(&record{}).Where("id = ?", 4).Update("data", []byte(`{"owner":"emilie"}`))
+	assert.Equal(t, &ChainError{ID: 4, Reason: "record was modified"}, db.Verify())
+
+	// So is a deleted one, once the edit is reverted
+	db.db.Model(&record{}).Where("id = ?", 4).Update("data", []byte(`{"owner":"florimond"}`))
+	assert.NoError(t, db.Verify())
+	db.db.Delete(&record{}, 7)
+	assert.Equal(t, &ChainError{ID: 8, Reason: "record 7 is missing"}, db.Verify())
+}
+
+func TestInspect(t *testing.T) {
+	db := openTest(t, "inspect")
+	for i := 0; i < 5; i++ {
+		_, err := db.Append(&AccountCreated{Owner: "florimond"})
+		assert.NoError(t, err)
+	}
+	_, err := db.Append(&MoneySent{From: "florimond", To: "emilie"})
+	assert.NoError(t, err)
+
+	db.db.Unscoped().Delete(&record{}, 2)
+	db.db.Delete(&record{}, 3)
+	db.db.Model(&record{}).Where("id = ?", 4).Update("data", []byte(`{"owner":`))
+
+	// A store which only knows some of the events, as an offline checker would
+	checker := openTest(t, "inspect")
+	checker.Register("account.created", &AccountCreated{})
+	visited := []Event{}
+	issues, err := checker.Inspect(func(e Event) {
+		visited = append(visited, e)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:florimond", "5:florimond"}, owners(visited))
+
+	problems := []string{}
+	for _, issue := range issues {
+		problems = append(problems, fmt.Sprintf("%d:%s", issue.EventID, issue.Problem))
+	}
+	assert.Equal(t, []string{
+		"3:" + IssueGap,
+		"3:" + IssueDeleted,
+		"4:" + IssueUndecodable,
+		"6:" + IssueUnknownName,
+		"4:" + IssueChain,
+	}, problems)
+}
+
+type CustomerJoined struct {
+	ID
+	Customer string `json:"customer" personal:"true"`
+	Email    string `json:"email" personal:"true"`
+	Plan     string `json:"plan"`
+}
+
+func (e *CustomerJoined) Name() string {
+	return "customer.joined"
+}
+
+func (e *CustomerJoined) Subject() string {
+	return e.Customer
+}
+
+func TestForget(t *testing.T) {
+	db := openTest(t, "forget")
+
+	alice := &CustomerJoined{Customer: "alice", Email: "alice@example.com", Plan: "gold"}
+	bob := &CustomerJoined{Customer: "bob", Email: "bob@example.com", Plan: "basic"}
+	assert.NoError(t, db.AppendAll(alice, bob))
+
+	// The personal data is encrypted in the payload, and the event keeps it in clear
+	rec := record{}
+	assert.NoError(t, db.db.First(&rec, alice.EventID).Error)
+	assert.NotContains(t, string(rec.Data), "alice")
+	assert.Contains(t, string(rec.Data), "gold")
+	assert.Equal(t, "alice", alice.Customer)
+
+	changes, err := db.FindChanges(0, "customer.joined")
+	assert.NoError(t, err)
+	assert.Equal(t, alice.Email, changes[0].(*CustomerJoined).Email)
+
+	// Once forgotten, the data of the subject is redacted and the rest is untouched
+	assert.NoError(t, db.Forget("alice"))
+	changes, err = db.FindChanges(0, "customer.joined")
+	assert.NoError(t, err)
+	assert.Equal(t, &CustomerJoined{Customer: Redacted, Email: Redacted, Plan: "gold"}, plain(changes[0]))
+	assert.Equal(t, &CustomerJoined{Customer: "bob", Email: "bob@example.com", Plan: "basic"}, plain(changes[1]))
+	assert.NoError(t, db.Verify())
+
+	assert.Error(t, db.Forget("alice"))
+
+	// The ID of the key left on the records can't be derived from the subject
+	assert.NoError(t, db.db.First(&rec, alice.EventID).Error)
+	assert.NotEmpty(t, rec.KeyID)
+	other := openTest(t, "forget-other")
+	assert.NoError(t, other.AppendAll(&CustomerJoined{Customer: "alice"}))
+	otherRec := record{}
+	assert.NoError(t, other.db.First(&otherRec, 1).Error)
+	assert.NotEqual(t, rec.KeyID, otherRec.KeyID)
+}
+
+// plain returns an event without its ID and metadata
+func plain(e Event) Event {
+	e.SetEventID(0)
+	e.SetMetadata(Metadata{})
+	return e
+}
+
+// flakyPublisher fails a number of times before publishing
+type flakyPublisher struct {
+	failures  int
+	published []Message
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, msg Message) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("unavailable")
+	}
+	p.published = append(p.published, msg)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	db := openTest(t, "outbox")
+
+	joined := &CustomerJoined{Customer: "alice", Email: "alice@example.com"}
+	assert.NoError(t, db.AppendAll(&AccountCreated{Owner: "florimond"}, joined))
+
+	publisher := &flakyPublisher{failures: 20}
+	relay := NewRelay(db, publisher)
+	assert.Equal(t, 2*time.Second, relay.backoff(2))
+	assert.Equal(t, relay.MaxBackoff, relay.backoff(100))
+	relay.Backoff = 0
+
+	// A failure stops the delivery, and the event is tried again later, never given up on
+	for i := 0; i < 20; i++ {
+		delivered, err := relay.Deliver(context.Background())
+		assert.Error(t, err)
+		assert.Equal(t, 0, delivered)
+	}
+
+	delivered, err := relay.Deliver(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, "account.created", publisher.published[0].Name)
+	assert.JSONEq(t, `{"owner":"florimond"}`, string(publisher.published[0].Data))
+
+	// Personal data is never published, as it could not be forgotten there
+	assert.JSONEq(t, `{"customer":"[redacted]","email":"[redacted]","plan":""}`, string(publisher.published[1].Data))
+
+	// Delivered events are not published again
+	delivered, err = relay.Deliver(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+}
+
+func TestFilePublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "events.jsonl")
+	publisher := NewFilePublisher(name)
+	assert.NoError(t, publisher.Publish(context.Background(), Message{ID: 1, Name: "account.created", Data: []byte(`{}`)}))
+	assert.NoError(t, publisher.Publish(context.Background(), Message{ID: 2, Name: "account.created", Data: []byte(`{}`)}))
+
+	b, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(b), "\n"))
+}
@@ -0,0 +1,118 @@
+package event
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// subscriptionBatch is the number of events read at once by a subscription
+const subscriptionBatch = 100
+
+// hub wakes up the subscriptions of a store when events are appended
+type hub struct {
+	subsLock sync.Mutex
+	subs     map[chan struct{}]struct{}
+}
+
+// newHub creates a hub without subscriptions
+func newHub() hub {
+	return hub{
+		subs: make(map[chan struct{}]struct{}),
+	}
+}
+
+// notify wakes up the subscriptions after events were committed
+func (h *hub) notify() {
+	h.subsLock.Lock()
+	defer h.subsLock.Unlock()
+
+	for wake := range h.subs {
+		select {
+		case wake <- struct{}{}:
+		default: // Already woken up
+		}
+	}
+}
+
+// watch returns a channel which receives a value when events are appended, and the
+// function to stop watching
+func (h *hub) watch() (chan struct{}, func()) {
+	wake := make(chan struct{}, 1)
+	h.subsLock.Lock()
+	h.subs[wake] = struct{}{}
+	h.subsLock.Unlock()
+
+	return wake, func() {
+		h.subsLock.Lock()
+		delete(h.subs, wake)
+		h.subsLock.Unlock()
+	}
+}
+
+// subscribe delivers the events read by find after a checkpoint, then reads again
+// each time the hub is notified, until the context is cancelled. find returns at
+// most limit records, which makeEvents turns into events.
+//
+// Events are read in batches, and the next batch is only read once the previous one
+// was received, so a slow consumer only holds back its own subscription and never
+// the writers.
+func (h *hub) subscribe(ctx context.Context, after uint,
+	find func(after uint, limit int) ([]record, error),
+	makeEvents func(records []record) ([]Event, error)) (<-chan Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Subscribe before reading the backlog so no append is missed in between
+	wake, stop := h.watch()
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer stop()
+
+		for {
+			records, err := find(after, subscriptionBatch)
+			if err != nil {
+				log.Println("event: subscription stopped:", err)
+				return
+			}
+
+			events, err := makeEvents(records)
+			if err != nil {
+				log.Println("event: subscription stopped:", err)
+				return
+			}
+
+			for i, event := range events {
+				select {
+				case out <- event:
+					after = records[i].ID
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// Wait for new events once the backlog is drained
+			if len(records) < subscriptionBatch {
+				select {
+				case <-wake:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Subscribe delivers the events after a checkpoint, then the new ones as they are
+// appended, until the context is cancelled. The channel is closed when the
+// subscription ends.
+func (s *Storage) Subscribe(ctx context.Context, after uint, names ...string) (<-chan Event, error) {
+	return s.subscribe(ctx, after, func(after uint, limit int) ([]record, error) {
+		return s.find(s.db, after, limit, names)
+	}, s.makeEvents)
+}
@@ -0,0 +1,61 @@
+package event
+
+import (
+	"fmt"
+)
+
+// Versioned represents an event whose payload changed shape over time. Events which
+// don't implement it are at version 1.
+type Versioned interface {
+	SchemaVersion() uint
+}
+
+// Upcaster converts the JSON payload of an event from a version to the next one
+type Upcaster func(data []byte) ([]byte, error)
+
+// schemaVersion returns the version of the payload of an event
+func schemaVersion(event Event) uint {
+	if v, ok := event.(Versioned); ok {
+		return v.SchemaVersion()
+	}
+	return 1
+}
+
+// Upcast registers an upcaster which converts the payload of an event from a version
+// to the next one, so old events are read into the current shape of the event
+func (r *registry) Upcast(name string, from uint, upcaster Upcaster) {
+	r.typesLock.Lock()
+	defer r.typesLock.Unlock()
+
+	if _, ok := r.upcasters[name]; !ok {
+		r.upcasters[name] = make(map[uint]Upcaster)
+	}
+	r.upcasters[name][from] = upcaster
+}
+
+// upcast converts the payload of a record up to a version
+func (r *registry) upcast(rec *record, to uint) ([]byte, error) {
+	r.typesLock.RLock()
+	defer r.typesLock.RUnlock()
+
+	data, version := rec.Data, rec.SchemaVersion
+	if version == 0 {
+		version = 1 // Records stored before versioning
+	}
+	if version > to {
+		return nil, fmt.Errorf("event: %s %d is at version %d, newer than %d", rec.Name, rec.ID, version, to)
+	}
+
+	for ; version < to; version++ {
+		upcaster, ok := r.upcasters[rec.Name][version]
+		if !ok {
+			return nil, fmt.Errorf("event: no upcaster for %s from version %d", rec.Name, version)
+		}
+
+		var err error
+		if data, err = upcaster(data); err != nil {
+			return nil, fmt.Errorf("event: upcasting %s %d from version %d: %v", rec.Name, rec.ID, version, err)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,155 @@
+package fx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/florhusq/digibank/money"
+)
+
+// rateDecimals is the number of decimals rates are rounded to, so the rate recorded
+// on an event is exactly the one applied
+const rateDecimals = 8
+
+var errRate = errors.New("fx: a rate is a positive decimal number")
+
+// Rate represents the number of units of a currency which one unit of another buys
+type Rate struct {
+	rat *big.Rat
+}
+
+// ParseRate parses a decimal rate, such as "1.085"
+func ParseRate(s string) (Rate, error) {
+	rat, ok := new(big.Rat).SetString(s)
+	if !ok || rat.Sign() <= 0 {
+		return Rate{}, errRate
+	}
+	return Rate{rat: round(rat, rateDecimals)}, nil
+}
+
+// round rounds a number to a number of decimals, half away from zero
+func round(rat *big.Rat, decimals int) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	n := new(big.Rat).Mul(rat, new(big.Rat).SetInt(scale))
+	return new(big.Rat).SetFrac(roundInt(n), scale)
+}
+
+// roundInt rounds a number to the nearest integer, half away from zero
+func roundInt(rat *big.Rat) *big.Int {
+	num, den := new(big.Int).Abs(rat.Num()), rat.Denom()
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Mul(r, big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if rat.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q
+}
+
+// Convert converts an amount at the rate, rounded to the minor unit
+func (r Rate) Convert(amount money.Amount) (money.Amount, error) {
+	if r.rat == nil {
+		return 0, errRate
+	}
+
+	converted := roundInt(new(big.Rat).Mul(new(big.Rat).SetInt64(int64(amount)), r.rat))
+	if !converted.IsInt64() {
+		return 0, money.ErrOverflow
+	}
+	return money.Amount(converted.Int64()), nil
+}
+
+// String returns the rate as a decimal number
+func (r Rate) String() string {
+	if r.rat == nil {
+		return "0"
+	}
+	return r.rat.FloatString(rateDecimals)
+}
+
+// MarshalJSON writes the rate as a decimal string, so it is not read back as a float
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON reads the rate from a decimal string
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	rate, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// Table holds the rates of currencies against a base currency
+type Table struct {
+	base  money.Currency
+	rates map[money.Currency]*big.Rat // Units of each currency one unit of the base buys
+}
+
+// NewTable creates a table of rates against a base currency, given as decimals
+func NewTable(base money.Currency, rates map[money.Currency]string) (*Table, error) {
+	t := &Table{
+		base:  base,
+		rates: map[money.Currency]*big.Rat{base: big.NewRat(1, 1)},
+	}
+	for currency, s := range rates {
+		if _, err := money.ParseCurrency(string(currency)); err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(s)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s", err, currency)
+		}
+		t.rates[currency] = rate.rat
+	}
+	return t, nil
+}
+
+// Load loads a table from a JSON file such as:
+//
+//	{"base": "EUR", "rates": {"USD": "1.085", "GBP": "0.856"}}
+func Load(filename string) (*Table, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content := struct {
+		Base  money.Currency            `json:"base"`
+		Rates map[money.Currency]string `json:"rates"`
+	}{}
+	if err := json.NewDecoder(file).Decode(&content); err != nil {
+		return nil, err
+	}
+	if _, err := money.ParseCurrency(string(content.Base)); err != nil {
+		return nil, err
+	}
+	return NewTable(content.Base, content.Rates)
+}
+
+// Base returns the currency the rates are given against
+func (t *Table) Base() money.Currency {
+	return t.base
+}
+
+// Rate returns the rate to convert from a currency to another
+func (t *Table) Rate(from, to money.Currency) (Rate, error) {
+	rateFrom, okFrom := t.rates[from]
+	rateTo, okTo := t.rates[to]
+	if !okFrom || !okTo {
+		return Rate{}, fmt.Errorf("fx: no rate from %s to %s", from, to)
+	}
+	return Rate{rat: round(new(big.Rat).Quo(rateTo, rateFrom), rateDecimals)}, nil
+}
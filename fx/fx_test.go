@@ -0,0 +1,69 @@
+package fx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/florhusq/digibank/money"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRate(t *testing.T) {
+	table, err := NewTable("EUR", map[money.Currency]string{
+		"USD": "1.25",
+		"GBP": "0.8",
+	})
+	assert.NoError(t, err)
+
+	rate, err := table.Rate("EUR", "USD")
+	assert.NoError(t, err)
+	amount, err := rate.Convert(1001)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Amount(1251), amount) // 12.5125 rounded
+
+	// Cross rates go through the base currency
+	rate, err = table.Rate("USD", "GBP")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.64000000", rate.String())
+	rate, err = table.Rate("GBP", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.56250000", rate.String())
+
+	_, err = table.Rate("EUR", "JPY")
+	assert.Error(t, err)
+
+	_, err = NewTable("EUR", map[money.Currency]string{"USD": "-1"})
+	assert.Error(t, err)
+}
+
+func TestRateJSON(t *testing.T) {
+	rate, err := ParseRate("1.085")
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(rate)
+	assert.NoError(t, err)
+	assert.Equal(t, `"1.08500000"`, string(b))
+
+	read := Rate{}
+	assert.NoError(t, json.Unmarshal(b, &read))
+	assert.Equal(t, rate.String(), read.String())
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fx")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "rates.json")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(`{"base": "EUR", "rates": {"USD": "1.085"}}`), 0644))
+	table, err := Load(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, money.Currency("EUR"), table.Base())
+
+	rate, err := table.Rate("USD", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.92165899", rate.String())
+}
@@ -3,11 +3,13 @@ module github.com/florhusq/digibank
 go 1.14
 
 require (
+	github.com/fergusstrange/embedded-postgres v1.10.0
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.7.3
 	github.com/ilyakaznacheev/cleanenv v1.2.5
 	github.com/prometheus/client_golang v1.8.0
 	github.com/stretchr/testify v1.6.1
+	gorm.io/driver/postgres v1.0.5
 	gorm.io/driver/sqlite v1.1.3
 	gorm.io/gorm v1.20.5
 )
@@ -1,21 +1,126 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/florhusq/digibank/account"
 	"github.com/florhusq/digibank/config"
 	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/fx"
+	"github.com/florhusq/digibank/money"
+	"github.com/florhusq/digibank/projection"
 	"github.com/florhusq/digibank/rest"
 )
 
+// Usage:
+//
+//	digibank          serves the API
+//	digibank export [--keys]
+//	                  writes the events to stdout in JSON Lines. With --keys, the keys
+//	                  of the personal data are written in clear too: a customer
+//	                  forgotten afterwards can still be read from such an export.
+//	digibank import   appends the events read from stdin in JSON Lines
+//	digibank verify   checks the events and writes a JSON report to stdout, exiting
+//	                  with 1 if any problem was found
+//	digibank rebuild <projection>
+//	                  rebuilds a read model from all of the events
 func main() {
 	config, err := config.Load("config.json")
 	if err != nil {
 		panic(err)
 	}
 
-	db, err := event.Open(config.Storage.Connection)
+	db, err := event.New(config.Storage)
+	if err != nil {
+		panic(err)
+	}
+
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	// The accounts opened without a currency are in the base currency
+	base := money.DefaultCurrency
+	if config.Currency.Base != "" {
+		if base, err = money.ParseCurrency(config.Currency.Base); err != nil {
+			panic(err)
+		}
+	}
+
+	// The read models fed from the events
+	history, err := account.NewHistory(db.DB(), db, base)
+	if err != nil {
+		panic(err)
+	}
+	projections := projection.NewRunner(db, history)
+
+	switch command {
+	case "export":
+		err = db.Export(os.Stdout, len(os.Args) > 2 && os.Args[2] == "--keys")
+	case "import":
+		err = db.Import(os.Stdin)
+	case "verify":
+		var report *account.Report
+		if report, err = account.Verify(db, base); err == nil {
+			err = json.NewEncoder(os.Stdout).Encode(report)
+		}
+		if err == nil && !report.OK {
+			os.Exit(1)
+		}
+	case "rebuild":
+		if len(os.Args) < 3 {
+			panic("digibank rebuild <projection>")
+		}
+		err = projections.Rebuild(os.Args[2])
+	default:
+		var publisher event.Publisher
+		if publisher, err = event.NewPublisher(config.Outbox); err != nil {
+			panic(err)
+		}
+		if publisher != nil {
+			go event.NewRelay(db, publisher).Run(context.Background())
+		}
+		go projections.Run(context.Background())
+
+		options := []account.Option{
+			account.WithSnapshots(db, config.Snapshot.Interval),
+			account.WithReplayMode(account.ReplayMode(config.Replay.Mode)),
+			account.WithBaseCurrency(base),
+		}
+		limits := account.Limits{
+			account.ChannelWithdrawal: parseLimit(config.Limits.Withdrawal, config.Limits.WithdrawalDaily),
+			account.ChannelTransfer:   parseLimit(config.Limits.Transfer, config.Limits.TransferDaily),
+		}
+		options = append(options, account.WithLimits(limits))
+		if config.Currency.Rates != "" {
+			var rates *fx.Table
+			if rates, err = fx.Load(config.Currency.Rates); err != nil {
+				panic(err)
+			}
+			options = append(options, account.WithRates(rates))
+		}
+
+		err = rest.ServeAPI(config.Rest.Endpoint, config.Prometheus.Endpoint, db, history, options...)
+	}
 	if err != nil {
 		panic(err)
 	}
+}
 
-	rest.ServeAPI(config.Rest.Endpoint, config.Prometheus.Endpoint, db)
+// parseLimit parses the caps of a limit, an empty one meaning no limit
+func parseLimit(perTransaction, daily string) account.Limit {
+	parse := func(s string) money.Amount {
+		if s == "" {
+			return 0
+		}
+		amount, err := money.Parse(s)
+		if err != nil {
+			panic(err)
+		}
+		return amount
+	}
+	return account.Limit{PerTransaction: parse(perTransaction), Daily: parse(daily)}
 }
@@ -0,0 +1,29 @@
+package money
+
+import (
+	"errors"
+)
+
+// DefaultCurrency is the currency of the accounts opened before currencies existed,
+// unless configured otherwise
+const DefaultCurrency = Currency("EUR")
+
+// ErrCurrency is returned for a code which is not a currency code
+var ErrCurrency = errors.New("money: a currency is an ISO 4217 code of 3 capital letters")
+
+// Currency represents an ISO 4217 currency code, such as EUR. Amounts of every
+// currency are kept with the same number of decimals.
+type Currency string
+
+// ParseCurrency checks that a code looks like an ISO 4217 currency code
+func ParseCurrency(code string) (Currency, error) {
+	if len(code) != 3 {
+		return "", ErrCurrency
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return "", ErrCurrency
+		}
+	}
+	return Currency(code), nil
+}
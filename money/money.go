@@ -0,0 +1,117 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Decimals is the number of digits of the minor unit
+const Decimals = 2
+
+// scale is the number of minor units in a major unit
+const scale = 100
+
+var (
+	// ErrOverflow is returned when an amount does not fit in 64 bits of minor units
+	ErrOverflow = errors.New("money: overflow")
+
+	errSyntax = errors.New("money: invalid amount")
+)
+
+// Amount represents an amount of money in minor units, such as cents, so that
+// arithmetic is exact. It is written in JSON as a decimal number, such as 12.50.
+type Amount int64
+
+// Parse parses a decimal amount such as "12.5" or "-3", which must not be more precise
+// than the minor unit
+func Parse(s string) (Amount, error) {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	units, cents := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, cents = s[:i], s[i+1:]
+		if cents == "" || len(cents) > Decimals {
+			return 0, errSyntax
+		}
+	}
+	if units == "" || strings.IndexFunc(units+cents, isNotDigit) >= 0 {
+		return 0, errSyntax
+	}
+	cents += strings.Repeat("0", Decimals-len(cents))
+
+	n, err := strconv.ParseInt(units+cents, 10, 64)
+	if err != nil {
+		return 0, ErrOverflow
+	}
+	if negative {
+		n = -n
+	}
+	return Amount(n), nil
+}
+
+// isNotDigit tells if a rune is not a decimal digit
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+// FromFloat converts an amount stored as a float, rounding it to the nearest minor
+// unit
+func FromFloat(f float64) (Amount, error) {
+	minor := math.Round(f * scale)
+	if math.IsNaN(minor) || minor >= math.MaxInt64 || minor < math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return Amount(minor), nil
+}
+
+// Add returns the sum of two amounts, or ErrOverflow
+func (a Amount) Add(b Amount) (Amount, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, ErrOverflow
+	}
+	return sum, nil
+}
+
+// Sub returns the difference of two amounts, or ErrOverflow
+func (a Amount) Sub(b Amount) (Amount, error) {
+	diff := a - b
+	if (b > 0 && diff > a) || (b < 0 && diff < a) {
+		return 0, ErrOverflow
+	}
+	return diff, nil
+}
+
+// String returns the amount as a decimal number
+func (a Amount) String() string {
+	sign, n := "", uint64(a)
+	if a < 0 {
+		sign, n = "-", uint64(-a) // Also right for math.MinInt64
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, n/scale, Decimals, n%scale)
+}
+
+// MarshalJSON writes the amount as a decimal number
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON reads the amount from a decimal number, without going through a
+// float
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+
+	amount, err := Parse(strings.Trim(s, `"`))
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, s)
+	}
+	*a = amount
+	return nil
+}
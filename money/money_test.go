@@ -0,0 +1,79 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for s, expected := range map[string]Amount{
+		"12":    1200,
+		"12.5":  1250,
+		"12.50": 1250,
+		"0.01":  1,
+		"-3.2":  -320,
+	} {
+		amount, err := Parse(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, amount, s)
+	}
+
+	for _, s := range []string{"", "-", ".5", "1.", "1.234", "1e2", "1,5", "+1", "99999999999999999999"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a, _ := Parse("0.1")
+	b, _ := Parse("0.2")
+	sum, err := a.Add(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "0.30", sum.String())
+
+	diff, err := a.Sub(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "-0.10", diff.String())
+
+	_, err = Amount(math.MaxInt64).Add(1)
+	assert.Equal(t, ErrOverflow, err)
+	_, err = Amount(math.MinInt64).Sub(1)
+	assert.Equal(t, ErrOverflow, err)
+	assert.Equal(t, "-92233720368547758.08", Amount(math.MinInt64).String())
+}
+
+func TestFromFloat(t *testing.T) {
+	amount, err := FromFloat(0.1 + 0.2)
+	assert.NoError(t, err)
+	assert.Equal(t, Amount(30), amount)
+
+	_, err = FromFloat(math.Inf(1))
+	assert.Equal(t, ErrOverflow, err)
+}
+
+func TestJSON(t *testing.T) {
+	payload := struct {
+		Amount Amount `json:"amount"`
+	}{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount":20.05}`), &payload))
+	assert.Equal(t, Amount(2005), payload.Amount)
+	assert.Error(t, json.Unmarshal([]byte(`{"amount":0.30000000000000004}`), &payload))
+
+	b, err := json.Marshal(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"amount":20.05}`, string(b))
+}
+
+func TestParseCurrency(t *testing.T) {
+	currency, err := ParseCurrency("USD")
+	assert.NoError(t, err)
+	assert.Equal(t, Currency("USD"), currency)
+
+	for _, code := range []string{"", "usd", "US", "EURO", "U$D"} {
+		_, err := ParseCurrency(code)
+		assert.Error(t, err, code)
+	}
+}
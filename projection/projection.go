@@ -0,0 +1,164 @@
+package projection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/florhusq/digibank/event"
+)
+
+// readBatch is the number of events read at once while catching up, and how often
+// the checkpoint is saved meanwhile
+const readBatch = 500
+
+// Projection is a read model fed from the events of the store. An event may be
+// handled again after a crash, between two checkpoints, so Handle must be
+// idempotent, for instance on the ID of the event.
+type Projection interface {
+	Name() string               // Name under which the checkpoint is saved
+	Events() []string           // Names of the events the projection is fed with
+	Handle(e event.Event) error // Applies an event to the read model
+	Reset() error               // Drops the read model before it is rebuilt
+}
+
+// Store is the event store the projections are fed from, which keeps their
+// checkpoints too
+type Store interface {
+	Iterate(after uint, limit int, names ...string) *event.Iterator
+	Subscribe(ctx context.Context, after uint, names ...string) (<-chan event.Event, error)
+	LoadCheckpoint(name string) (uint, error)
+	SaveCheckpoint(name string, eventID uint) error
+}
+
+// Runner feeds projections from a store, each from its own checkpoint
+type Runner struct {
+	store       Store
+	projections []Projection
+}
+
+// NewRunner creates a runner of projections fed from a store
+func NewRunner(store Store, projections ...Projection) *Runner {
+	return &Runner{
+		store:       store,
+		projections: projections,
+	}
+}
+
+// CatchUp feeds each projection with the events after its checkpoint, up to the
+// last one appended
+func (r *Runner) CatchUp() error {
+	for _, p := range r.projections {
+		if _, err := r.catchUp(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run catches up, then feeds the projections with the events as they are appended,
+// until the context is cancelled. A projection which fails is stopped, without
+// stopping the others.
+func (r *Runner) Run(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+	for _, p := range r.projections {
+		wg.Add(1)
+		go func(p Projection) {
+			defer wg.Done()
+			if err := r.run(ctx, p); err != nil && ctx.Err() == nil {
+				log.Printf("projection: %s stopped: %v", p.Name(), err)
+			}
+		}(p)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Rebuild resets a projection and feeds it again with all of the events
+func (r *Runner) Rebuild(name string) error {
+	for _, p := range r.projections {
+		if p.Name() != name {
+			continue
+		}
+
+		if err := p.Reset(); err != nil {
+			return err
+		}
+		if err := r.store.SaveCheckpoint(name, 0); err != nil {
+			return err
+		}
+		_, err := r.catchUp(p)
+		return err
+	}
+	return fmt.Errorf("projection: no projection named %s", name)
+}
+
+// run catches up a projection, then feeds it live
+func (r *Runner) run(ctx context.Context, p Projection) error {
+	after, err := r.catchUp(p)
+	if err != nil {
+		return err
+	}
+
+	events, err := r.store.Subscribe(ctx, after, p.Events()...)
+	if err != nil {
+		return err
+	}
+	for e := range events {
+		if err := r.handle(p, e); err != nil {
+			return err
+		}
+		if err := r.store.SaveCheckpoint(p.Name(), event.IDOf(e)); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() == nil {
+		return fmt.Errorf("projection: subscription of %s ended", p.Name())
+	}
+	return nil
+}
+
+// catchUp feeds a projection with the events after its checkpoint, and returns the
+// ID of the last event handled. The progress is saved even if an event fails.
+func (r *Runner) catchUp(p Projection) (uint, error) {
+	after, err := r.store.LoadCheckpoint(p.Name())
+	if err != nil {
+		return 0, err
+	}
+	saved := after
+
+	it := r.store.Iterate(after, readBatch, p.Events()...)
+	for it.Next() {
+		if err = r.handle(p, it.Event()); err != nil {
+			break
+		}
+		after = event.IDOf(it.Event())
+
+		if after-saved >= readBatch {
+			if err := r.store.SaveCheckpoint(p.Name(), after); err != nil {
+				return saved, err
+			}
+			saved = after
+		}
+	}
+	if err == nil {
+		err = it.Err()
+	}
+
+	if after != saved {
+		if err := r.store.SaveCheckpoint(p.Name(), after); err != nil {
+			return saved, err
+		}
+	}
+	return after, err
+}
+
+// handle applies an event to a projection
+func (r *Runner) handle(p Projection, e event.Event) error {
+	if err := p.Handle(e); err != nil {
+		return fmt.Errorf("projection: %s failed on event %d: %w", p.Name(), event.IDOf(e), err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/florhusq/digibank/event"
+	"github.com/stretchr/testify/assert"
+)
+
+type Deposited struct {
+	event.ID
+	Amount int `json:"amount"`
+}
+
+func (e *Deposited) Name() string {
+	return "deposited"
+}
+
+// total sums the deposits, and fails on the ones over its limit
+type total struct {
+	lock  sync.Mutex
+	sum   int
+	limit int
+}
+
+func (p *total) Name() string {
+	return "total"
+}
+
+func (p *total) Events() []string {
+	return []string{"deposited"}
+}
+
+func (p *total) Handle(e event.Event) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	amount := e.(*Deposited).Amount
+	if p.limit > 0 && amount > p.limit {
+		return errors.New("too much")
+	}
+	p.sum += amount
+	return nil
+}
+
+func (p *total) Reset() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.sum = 0
+	return nil
+}
+
+func (p *total) value() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.sum
+}
+
+func TestCatchUp(t *testing.T) {
+	db := event.NewMemoryStore()
+	for _, amount := range []int{1, 2, 30, 4} {
+		_, err := db.Append(&Deposited{Amount: amount})
+		assert.NoError(t, err)
+	}
+
+	// The progress is kept up to the event which failed
+	p := &total{limit: 10}
+	err := NewRunner(db, p).CatchUp()
+	assert.Error(t, err)
+	assert.Equal(t, 3, p.value())
+	checkpoint, _ := db.LoadCheckpoint("total")
+	assert.Equal(t, uint(2), checkpoint)
+
+	// Catching up again resumes from the checkpoint
+	p.limit = 0
+	assert.NoError(t, NewRunner(db, p).CatchUp())
+	assert.Equal(t, 37, p.value())
+	checkpoint, _ = db.LoadCheckpoint("total")
+	assert.Equal(t, uint(4), checkpoint)
+
+	// A rebuild starts over
+	runner := NewRunner(db, p)
+	assert.NoError(t, runner.Rebuild("total"))
+	assert.Equal(t, 37, p.value())
+	assert.Error(t, runner.Rebuild("unknown"))
+}
+
+func TestRun(t *testing.T) {
+	db := event.NewMemoryStore()
+	_, err := db.Append(&Deposited{Amount: 1})
+	assert.NoError(t, err)
+
+	p := &total{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewRunner(db, p).Run(ctx)
+	}()
+
+	// Appended events are handled live
+	_, err = db.Append(&Deposited{Amount: 2})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		checkpoint, _ := db.LoadCheckpoint("total")
+		return checkpoint == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, p.value())
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -2,18 +2,25 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/florhusq/digibank/account"
 	"github.com/florhusq/digibank/event"
+	"github.com/florhusq/digibank/money"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 // bankHandler holds the manager and all the handlers
 type bankHandler struct {
 	Manager *account.Manager
+	History *account.History
 }
 
 // newAccountHandler handles requests of new account
@@ -21,7 +28,8 @@ func (h *bankHandler) newAccountHandler(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json;charset=utf8")
 
 	openReq := struct {
-		Customer string `json:"customer"`
+		Customer string         `json:"customer"`
+		Currency money.Currency `json:"currency"`
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&openReq); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -29,12 +37,20 @@ func (h *bankHandler) newAccountHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	account, err := h.Manager.Process(&account.OpenAccountCommand{Customer: openReq.Customer})
+	accountID, err := h.Manager.Process(r.Context(), &account.OpenAccountCommand{
+		Idempotent: idempotent(r),
+		Customer:   openReq.Customer,
+		Currency:   openReq.Currency,
+	})
+	if err != nil {
+		commandFailed(w, err)
+		return
+	}
 
 	resp := &struct {
 		Account string `json:"account"`
 	}{
-		Account: account,
+		Account: accountID,
 	}
 
 	if err = json.NewEncoder(w).Encode(resp); err != nil {
@@ -46,19 +62,60 @@ func (h *bankHandler) newAccountHandler(w http.ResponseWriter, r *http.Request)
 	//w.WriteHeader(http.StatusCreated)
 }
 
+// parseAsOf parses a point in the history, either an event ID or a RFC 3339 time
+func parseAsOf(value string) (account.AsOf, error) {
+	if id, err := strconv.ParseUint(value, 10, 0); err == nil {
+		return account.AsOf{EventID: uint(id)}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return account.AsOf{}, err
+	}
+	return account.AsOf{Time: t}, nil
+}
+
 // viewBalanceHandler handles request of the current balance for an account
 func (h *bankHandler) viewBalanceHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf8")
 
 	vars := mux.Vars(r)
-	account, ok := vars["account"]
+	accountID, ok := vars["account"]
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "{error: no account id found}")
 		return
 	}
 
-	balance, err := h.Manager.ViewBalance(account)
+	var acc account.Account
+	var err error
+	if r.URL.Query().Get("asOf") == "" {
+		if acc, err = h.Manager.ViewAccount(accountID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	} else {
+		var asOf account.AsOf
+		if asOf, err = parseAsOf(r.URL.Query().Get("asOf")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "{error: asOf is neither an event ID nor a RFC 3339 time}")
+			return
+		}
+
+		var accounts map[string]account.Account
+		if accounts, err = h.Manager.StateAt(asOf); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if acc, ok = accounts[accountID]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "{error: no such account at that time}")
+			return
+		}
+	}
+
+	available, err := acc.Available()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
@@ -66,11 +123,21 @@ func (h *bankHandler) viewBalanceHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	resp := &struct {
-		Account string  `json:"account"`
-		Balance float64 `json:"balance"`
+		Account        string         `json:"account"`
+		Balance        money.Amount   `json:"balance"`
+		Available      money.Amount   `json:"available"`
+		OverdraftLimit money.Amount   `json:"overdraftLimit"`
+		Currency       money.Currency `json:"currency"`
+		Status         account.Status `json:"status"`
+		Quarantined    bool           `json:"quarantined"`
 	}{
-		Account: account,
-		Balance: balance,
+		Account:        accountID,
+		Balance:        acc.Amount,
+		Available:      available,
+		OverdraftLimit: acc.OverdraftLimit,
+		Currency:       acc.Currency,
+		Status:         acc.Status,
+		Quarantined:    acc.Quarantined,
 	}
 
 	if err = json.NewEncoder(w).Encode(resp); err != nil {
@@ -83,9 +150,9 @@ func (h *bankHandler) viewBalanceHandler(w http.ResponseWriter, r *http.Request)
 func (h *bankHandler) newTransferHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf8")
 	transacReq := struct {
-		AccountFrom string  `json:"from"`
-		AccountTo   string  `json:"to"`
-		Amount      float64 `json:"amount"`
+		AccountFrom string       `json:"from"`
+		AccountTo   string       `json:"to"`
+		Amount      money.Amount `json:"amount"`
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&transacReq); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -93,13 +160,13 @@ func (h *bankHandler) newTransferHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if _, err := h.Manager.Process(&account.TransferCommand{
+	if _, err := h.Manager.Process(r.Context(), &account.TransferCommand{
+		Idempotent:  idempotent(r),
 		AccountFrom: transacReq.AccountFrom,
 		AccountTo:   transacReq.AccountTo,
 		Amount:      transacReq.Amount,
 	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		commandFailed(w, err)
 		return
 	}
 
@@ -110,8 +177,8 @@ func (h *bankHandler) newTransferHandler(w http.ResponseWriter, r *http.Request)
 func (h *bankHandler) newWithdrawHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf8")
 	transacReq := struct {
-		AccountFrom string  `json:"from"`
-		Amount      float64 `json:"amount"`
+		AccountFrom string       `json:"from"`
+		Amount      money.Amount `json:"amount"`
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&transacReq); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -119,24 +186,51 @@ func (h *bankHandler) newWithdrawHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if _, err := h.Manager.Process(&account.WithdrawCommand{
+	if _, err := h.Manager.Process(r.Context(), &account.WithdrawCommand{
+		Idempotent:  idempotent(r),
 		AccountFrom: transacReq.AccountFrom,
 		Amount:      transacReq.Amount,
 	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		commandFailed(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// commandFailed answers a request whose command was rejected, telling the client
+// when the request itself is at fault
+func commandFailed(w http.ResponseWriter, err error) {
+	var limit *account.LimitError
+	switch {
+	case errors.Is(err, money.ErrCurrency), errors.Is(err, account.ErrInvalidAmount):
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{error: %s}", err)
+	case errors.Is(err, account.ErrFrozen), errors.Is(err, account.ErrClosed), errors.Is(err, account.ErrNotFrozen),
+		errors.Is(err, account.ErrBalanceLeft), errors.Is(err, account.ErrQuarantined):
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "{error: %s}", err)
+	case errors.Is(err, account.ErrSweepToSelf):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "{error: %s}", err)
+	case errors.As(err, &limit):
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "{error: %s}", limit)
+	case errors.Is(err, account.ErrKeyReused):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "{error: %s}", err)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
 // newDepositHandler handles requests of new transaction deposit to an account
 func (h *bankHandler) newDepositHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf8")
 	transacReq := struct {
-		AccountTo string  `json:"to"`
-		Amount    float64 `json:"amount"`
+		AccountTo string       `json:"to"`
+		Amount    money.Amount `json:"amount"`
 	}{}
 	if err := json.NewDecoder(r.Body).Decode(&transacReq); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -144,12 +238,12 @@ func (h *bankHandler) newDepositHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if _, err := h.Manager.Process(&account.DepositCommand{
-		AccountTo: transacReq.AccountTo,
-		Amount:    transacReq.Amount,
+	if _, err := h.Manager.Process(r.Context(), &account.DepositCommand{
+		Idempotent: idempotent(r),
+		AccountTo:  transacReq.AccountTo,
+		Amount:     transacReq.Amount,
 	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		commandFailed(w, err)
 		return
 	}
 
@@ -161,14 +255,14 @@ func (h *bankHandler) viewTransactionHandler(w http.ResponseWriter, r *http.Requ
 	w.Header().Set("Content-Type", "application/json;charset=utf8")
 
 	vars := mux.Vars(r)
-	account, ok := vars["account"]
+	accountID, ok := vars["account"]
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "{error: no account id found}")
 		return
 	}
 
-	transactions, err := h.Manager.ViewTransactions(account)
+	entries, err := h.History.View(accountID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
@@ -176,16 +270,18 @@ func (h *bankHandler) viewTransactionHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	resp := make([]struct {
-		AccountFrom string  `json:"from"`   // The account which sends the money
-		AccountTo   string  `json:"to"`     // The account which receives the money
-		Amount      float64 `json:"amount"` // The amount
-	}, len(transactions))
+		account.HistoryEntry
+		AccountFrom string `json:"from"` // The account which sends the money
+		AccountTo   string `json:"to"`   // The account which receives the money
+	}, len(entries))
 
 	// Mapping
-	for i, t := range transactions {
-		resp[i].AccountFrom = t.AccountFrom
-		resp[i].AccountTo = t.AccountTo
-		resp[i].Amount = t.Amount
+	for i, entry := range entries {
+		resp[i].HistoryEntry = entry
+		resp[i].AccountFrom, resp[i].AccountTo = entry.Account, entry.Counterparty
+		if entry.Direction == account.DirectionIn {
+			resp[i].AccountFrom, resp[i].AccountTo = entry.Counterparty, entry.Account
+		}
 	}
 
 	if err = json.NewEncoder(w).Encode(resp); err != nil {
@@ -194,29 +290,205 @@ func (h *bankHandler) viewTransactionHandler(w http.ResponseWriter, r *http.Requ
 	}
 }
 
-func newBankHandler(db *event.Storage) *bankHandler {
-	manager, err := account.NewManager(db)
+// forgetCustomerHandler handles requests of erasure of the personal data of a customer
+func (h *bankHandler) forgetCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf8")
+
+	vars := mux.Vars(r)
+	customer, ok := vars["customer"]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "{error: no customer found}")
+		return
+	}
+
+	if err := h.Manager.ForgetCustomer(customer); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// freezeAccountHandler handles requests of freezing an account
+func (h *bankHandler) freezeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	freezeReq := struct {
+		Reason string `json:"reason"`
+	}{}
+	h.processAccountCommand(w, r, &freezeReq, func(accountID string) account.Command {
+		return &account.FreezeAccountCommand{
+			Idempotent: idempotent(r),
+			AccountID:  accountID,
+			Reason:     freezeReq.Reason,
+		}
+	})
+}
+
+// unfreezeAccountHandler handles requests of unfreezing an account
+func (h *bankHandler) unfreezeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	h.processAccountCommand(w, r, nil, func(accountID string) account.Command {
+		return &account.UnfreezeAccountCommand{
+			Idempotent: idempotent(r),
+			AccountID:  accountID,
+		}
+	})
+}
+
+// closeAccountHandler handles requests of closing an account, sweeping the money left
+// to another account if asked to
+func (h *bankHandler) closeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	closeReq := struct {
+		SweepTo string `json:"sweepTo"`
+	}{}
+	h.processAccountCommand(w, r, &closeReq, func(accountID string) account.Command {
+		return &account.CloseAccountCommand{
+			Idempotent: idempotent(r),
+			AccountID:  accountID,
+			SweepTo:    closeReq.SweepTo,
+		}
+	})
+}
+
+// overdraftHandler handles requests of changing the overdraft limit of an account
+func (h *bankHandler) overdraftHandler(w http.ResponseWriter, r *http.Request) {
+	overdraftReq := struct {
+		Limit money.Amount `json:"limit"`
+	}{}
+	h.processAccountCommand(w, r, &overdraftReq, func(accountID string) account.Command {
+		return &account.SetOverdraftLimitCommand{
+			Idempotent: idempotent(r),
+			AccountID:  accountID,
+			Limit:      overdraftReq.Limit,
+		}
+	})
+}
+
+// limitHandler handles requests of changing the limit of an account for a channel
+func (h *bankHandler) limitHandler(w http.ResponseWriter, r *http.Request) {
+	limitReq := struct {
+		Channel account.Channel `json:"channel"`
+		Limit   *account.Limit  `json:"limit"`
+	}{}
+	h.processAccountCommand(w, r, &limitReq, func(accountID string) account.Command {
+		return &account.SetLimitCommand{
+			Idempotent: idempotent(r),
+			AccountID:  accountID,
+			Channel:    limitReq.Channel,
+			Limit:      limitReq.Limit,
+		}
+	})
+}
+
+// processAccountCommand reads the optional body of a request on an account into req,
+// then processes the command built for the account and answers with its status
+func (h *bankHandler) processAccountCommand(w http.ResponseWriter, r *http.Request, req interface{}, command func(accountID string) account.Command) {
+	w.Header().Set("Content-Type", "application/json;charset=utf8")
+
+	vars := mux.Vars(r)
+	accountID, ok := vars["account"]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "{error: no account id found}")
+		return
+	}
+
+	if req != nil {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+	}
+
+	if _, err := h.Manager.Process(r.Context(), command(accountID)); err != nil {
+		commandFailed(w, err)
+		return
+	}
+
+	acc, err := h.Manager.ViewAccount(accountID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	resp := &struct {
+		Account string         `json:"account"`
+		Status  account.Status `json:"status"`
+	}{
+		Account: accountID,
+		Status:  acc.Status,
+	}
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+// idempotent reads the idempotency key of a request from the Idempotency-Key header,
+// so that a retried request is processed only once
+func idempotent(r *http.Request) account.Idempotent {
+	return account.Idempotent{IdempotencyKey: r.Header.Get("Idempotency-Key")}
+}
+
+// metadataMiddleware attaches the metadata of the events caused by a request to its
+// context. The request is identified by the X-Request-ID header, or a new ID if none
+// was given, and the principal by the X-Actor header.
+func metadataMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+		correlationID := r.Header.Get("X-Correlation-ID")
+		if correlationID == "" {
+			correlationID = requestID
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := event.NewContext(r.Context(), event.Metadata{
+			CorrelationID: correlationID,
+			CausationID:   requestID,
+			Actor:         r.Header.Get("X-Actor"),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newBankHandler(db *event.Storage, history *account.History, options ...account.Option) *bankHandler {
+	manager, err := account.NewManager(db, options...)
 	if err != nil {
 		panic(err)
 	}
 
-	return &bankHandler{Manager: manager}
+	return &bankHandler{Manager: manager, History: history}
 }
 
-// ServeAPI serves the API of the bank.
-func ServeAPI(endpoint, metricsEndpoint string, db *event.Storage) error {
+// ServeAPI serves the API of the bank. The transactions are read from the history,
+// which is fed separately.
+func ServeAPI(endpoint, metricsEndpoint string, db *event.Storage, history *account.History, options ...account.Option) error {
 	r := mux.NewRouter()
+	r.Use(metadataMiddleware)
 	accountRouter := r.PathPrefix("/account").Subrouter()
 	transferRouter := r.PathPrefix("/transfer").Subrouter()
+	customerRouter := r.PathPrefix("/customer").Subrouter()
 
-	handler := newBankHandler(db)
+	handler := newBankHandler(db, history, options...)
 
 	accountRouter.Methods("POST").Path("/").HandlerFunc(handler.newAccountHandler)
 	accountRouter.Methods("GET").Path("/{account}/").HandlerFunc(handler.viewBalanceHandler)
+	accountRouter.Methods("POST").Path("/{account}/freeze/").HandlerFunc(handler.freezeAccountHandler)
+	accountRouter.Methods("POST").Path("/{account}/unfreeze/").HandlerFunc(handler.unfreezeAccountHandler)
+	accountRouter.Methods("POST").Path("/{account}/close/").HandlerFunc(handler.closeAccountHandler)
+	accountRouter.Methods("POST").Path("/{account}/overdraft/").HandlerFunc(handler.overdraftHandler)
+	accountRouter.Methods("POST").Path("/{account}/limits/").HandlerFunc(handler.limitHandler)
 	transferRouter.Methods("POST").Path("/transfer/").HandlerFunc(handler.newTransferHandler)
 	transferRouter.Methods("POST").Path("/deposit/").HandlerFunc(handler.newDepositHandler)
 	transferRouter.Methods("POST").Path("/withdraw/").HandlerFunc(handler.newWithdrawHandler)
 	transferRouter.Methods("GET").Path("/{account}/").HandlerFunc(handler.viewTransactionHandler)
+	customerRouter.Methods("DELETE").Path("/{customer}/").HandlerFunc(handler.forgetCustomerHandler)
 
 	return http.ListenAndServe(endpoint, r)
 }